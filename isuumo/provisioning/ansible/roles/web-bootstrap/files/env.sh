@@ -3,3 +3,6 @@ MYSQL_PORT=3306
 MYSQL_USER=isucon
 MYSQL_DBNAME=isuumo
 MYSQL_PASS=isucon
+# ベンチマーカーは /initialize や入稿を認証なしで呼ぶので、管理用のルートの認証を外す
+# 鍵を配って認証する場合は ADMIN_KEYS_FILE を設定してこの行を消す
+ADMIN_ALLOW_UNAUTHENTICATED=true
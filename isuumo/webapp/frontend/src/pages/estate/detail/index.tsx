@@ -12,10 +12,17 @@ import { makeStyles, createStyles } from '@material-ui/core/styles'
 import { Loading } from '../../../components/Loading'
 
 import type { FC } from 'react'
-import type { Estate, Coordinate } from '@types'
+import type { Estate, EstateStatus, Coordinate } from '@types'
 import type { Theme } from '@material-ui/core/styles'
 import ErrorPage from 'next/error'
 
+const ESTATE_STATUS_LABELS: Record<EstateStatus, string> = {
+  available: '募集中',
+  applied: '申込あり',
+  contracted: '成約済み',
+  withdrawn: '掲載終了'
+}
+
 const usePageStyles = makeStyles((theme: Theme) =>
   createStyles({
     page: {
@@ -114,6 +121,7 @@ const EstateDetail: FC<Props> = ({ estate }) => {
         <p>説明: {estate.description}</p>
         <p>賃料: {estate.rent}円</p>
         <p>住所: {estate.address}</p>
+        <p>募集状況: {ESTATE_STATUS_LABELS[estate.status] ?? estate.status}</p>
         <LeafletMap
           className={classes.map}
           center={estateCoordinate}
@@ -3,6 +3,8 @@ export interface Estate {
   name: string
   thumbnail: string
   address: string
+  prefecture: string
+  city: string
   description: string
   doorHeight: number
   doorWidth: number
@@ -10,8 +12,12 @@ export interface Estate {
   latitude: number
   longitude: number
   rent: number
+  status: EstateStatus
+  statusChangedAt?: string
 }
 
+export type EstateStatus = 'available' | 'applied' | 'contracted' | 'withdrawn'
+
 export interface Chair {
   id: string
   name: string
@@ -52,6 +58,22 @@ export interface EstateSearchCondition {
   doorHeight: RangeCondition
   rent: RangeCondition
   feature: ListCondition
+  region?: RegionCondition
+}
+
+export interface CityCount {
+  name: string
+  count: number
+}
+
+export interface RegionCount {
+  prefecture: string
+  count: number
+  cities: CityCount[]
+}
+
+export interface RegionCondition {
+  list: RegionCount[]
 }
 
 export interface EstateSearchParams {
@@ -59,6 +81,8 @@ export interface EstateSearchParams {
   doorHeightRangeId: string
   rentRangeId: string
   features: string
+  prefecture?: string
+  city?: string
   page: number
   perPage: number
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const requestIDContextKey = "requestID"
+
+// accessLogFlushInterval バッファに溜めたアクセスログを書き出す間隔
+const accessLogFlushInterval = time.Second
+
+// AccessLogEntry kataribe や alp の代わりにルート単位で集計できるよう、生のパスではなくルートを持つ
+type AccessLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Route     string  `json:"route"`
+	URI       string  `json:"uri"`
+	Status    int     `json:"status"`
+	Latency   float64 `json:"latency"`
+	BytesIn   int64   `json:"bytes_in"`
+	BytesOut  int64   `json:"bytes_out"`
+	UserAgent string  `json:"user_agent"`
+	RemoteIP  string  `json:"remote_ip"`
+}
+
+// AccessLogger アクセスログを1行1JSONで書き出す
+type AccessLogger struct {
+	mu         sync.Mutex
+	w          *bufio.Writer
+	closer     io.Closer
+	sampleRate float64
+	done       chan struct{}
+}
+
+var accessLogger *AccessLogger
+
+// NewAccessLogger path が空ならアクセスログを出力しない。"-" なら標準出力に書き出す
+func NewAccessLogger(path string, sampleRate float64) (*AccessLogger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	var out io.Writer = os.Stdout
+	var closer io.Closer
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	}
+	l := &AccessLogger{
+		w:          bufio.NewWriter(out),
+		closer:     closer,
+		sampleRate: sampleRate,
+		done:       make(chan struct{}),
+	}
+	go l.flushLoop()
+	return l, nil
+}
+
+func (l *AccessLogger) flushLoop() {
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			l.w.Flush()
+			l.mu.Unlock()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *AccessLogger) write(entry AccessLogEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b)
+	l.w.WriteByte('\n')
+}
+
+// sampled サンプリング対象かどうか。5xx は常に記録する
+func (l *AccessLogger) sampled(status int) bool {
+	if status >= 500 || l.sampleRate >= 1 {
+		return true
+	}
+	return mathrand.Float64() < l.sampleRate
+}
+
+func (l *AccessLogger) Close() error {
+	close(l.done)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if l.closer != nil {
+		return l.closer.Close()
+	}
+	return nil
+}
+
+func (l *AccessLogger) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		req := c.Request()
+		res := c.Response()
+		if !l.sampled(res.Status) {
+			return nil
+		}
+		l.write(AccessLogEntry{
+			Time:      start.Format(time.RFC3339Nano),
+			RequestID: requestID(c),
+			Method:    req.Method,
+			Route:     c.Path(),
+			URI:       req.RequestURI,
+			Status:    res.Status,
+			Latency:   time.Since(start).Seconds(),
+			BytesIn:   req.ContentLength,
+			BytesOut:  res.Size,
+			UserAgent: req.UserAgent(),
+			RemoteIP:  c.RealIP(),
+		})
+		return nil
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestIDMiddleware X-Request-ID を引き継ぐか新しく発行し、レスポンスヘッダとコンテキストに設定する
+func RequestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(echo.HeaderXRequestID)
+		if id == "" {
+			id = newRequestID()
+		}
+		c.Set(requestIDContextKey, id)
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		return next(c)
+	}
+}
+
+func requestID(c echo.Context) string {
+	id, _ := c.Get(requestIDContextKey).(string)
+	return id
+}
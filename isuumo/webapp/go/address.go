@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+)
+
+// prefectures 都道府県コード順
+var prefectures = []string{
+	"北海道", "青森県", "岩手県", "宮城県", "秋田県", "山形県", "福島県",
+	"茨城県", "栃木県", "群馬県", "埼玉県", "千葉県", "東京都", "神奈川県",
+	"新潟県", "富山県", "石川県", "福井県", "山梨県", "長野県", "岐阜県",
+	"静岡県", "愛知県", "三重県", "滋賀県", "京都府", "大阪府", "兵庫県",
+	"奈良県", "和歌山県", "鳥取県", "島根県", "岡山県", "広島県", "山口県",
+	"徳島県", "香川県", "愛媛県", "高知県", "福岡県", "佐賀県", "長崎県",
+	"熊本県", "大分県", "宮崎県", "鹿児島県", "沖縄県",
+}
+
+var prefectureOrder = func() map[string]int {
+	m := make(map[string]int, len(prefectures))
+	for i, p := range prefectures {
+		m[p] = i
+	}
+	return m
+}()
+
+// irregularCities 名前の途中に「郡」や「村」を含み、字だけでは区切れない市
+var irregularCities = []string{"大和郡山市", "小郡市", "東村山市", "武蔵村山市"}
+
+// irregularCounties 名前に「市」や「村」を含む郡
+var irregularCounties = []string{"余市郡", "高市郡", "田村郡", "北村山郡", "西村山郡", "東村山郡"}
+
+// splitMunicipality 住所の先頭から市区町村名を切り出す
+// 「四日市市」「大町市」「十日町市」のように市区町村名自体に「市」や「町」を含む場合は、後ろに続く字を見て区切る位置を決める
+func splitMunicipality(s string) string {
+	for _, city := range irregularCities {
+		if strings.HasPrefix(s, city) {
+			return city
+		}
+	}
+	runes := []rune(s)
+	start, county := 0, false
+	for _, name := range irregularCounties {
+		if strings.HasPrefix(s, name) {
+			start, county = len([]rune(name)), true
+		}
+	}
+	// 「西多摩郡日の出町」のような郡部は郡名を含めて町村までを市区町村名とする
+	if i := strings.IndexRune(s, '郡'); !county && i > 0 {
+		gun := len([]rune(s[:i]))
+		if !strings.ContainsAny(string(runes[:gun]), "市区町村") {
+			start, county = gun+1, true
+		}
+	}
+	for i := start + 1; i < len(runes); i++ {
+		c, next := runes[i], rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case county && (c == '町' || c == '村'):
+			// 郡の下は町か村なので、「玉村町」のように町村の字が続けばそこまでを名前とする
+			if next == '町' || next == '村' {
+				continue
+			}
+		case !county && (c == '市' || c == '区'):
+			if next == c {
+				continue
+			}
+		case !county && (c == '町' || c == '村'):
+			// 「大町市」「羽村市」
+			if next == c || next == '市' {
+				continue
+			}
+		default:
+			continue
+		}
+		return string(runes[:i+1])
+	}
+	return ""
+}
+
+// parseAddress 住所から都道府県と市区町村を取り出す。判別できなかった部分は空文字を返す
+func parseAddress(address string) (string, string) {
+	address = strings.TrimSpace(address)
+	for _, p := range prefectures {
+		if strings.HasPrefix(address, p) {
+			return p, splitMunicipality(address[len(p):])
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func Test_ParseAddress(t *testing.T) {
+	for _, tc := range []struct {
+		address    string
+		prefecture string
+		city       string
+	}{
+		{"東京都新宿区西新宿2-8-1", "東京都", "新宿区"},
+		{"東京都荒川区町屋1-2-3", "東京都", "荒川区"},
+		{"東京都町田市森野2-2-22", "東京都", "町田市"},
+		{"東京都東村山市本町1-2-3", "東京都", "東村山市"},
+		{"東京都武蔵村山市本町1-1-1", "東京都", "武蔵村山市"},
+		{"東京都羽村市緑ヶ丘5-2-1", "東京都", "羽村市"},
+		{"東京都西多摩郡日の出町平井2780", "東京都", "西多摩郡日の出町"},
+		{"神奈川県横浜市中区日本大通1", "神奈川県", "横浜市"},
+		{"三重県四日市市諏訪町1-5", "三重県", "四日市市"},
+		{"広島県廿日市市下平良1-11-1", "広島県", "廿日市市"},
+		{"千葉県市川市八幡1-1-1", "千葉県", "市川市"},
+		{"長野県大町市大町3887", "長野県", "大町市"},
+		{"新潟県十日町市千歳町3-3", "新潟県", "十日町市"},
+		{"長崎県大村市玖島1-25", "長崎県", "大村市"},
+		{"福島県田村市船引町船引字畑添76-2", "福島県", "田村市"},
+		{"福島県田村郡三春町大町1-2", "福島県", "田村郡三春町"},
+		{"群馬県佐波郡玉村町下新田201", "群馬県", "佐波郡玉村町"},
+		{"佐賀県杵島郡大町町大町5017", "佐賀県", "杵島郡大町町"},
+		{"北海道余市郡余市町朝日町4", "北海道", "余市郡余市町"},
+		{"富山県中新川郡上市町横法音寺40", "富山県", "中新川郡上市町"},
+		{"奈良県高市郡明日香村岡55", "奈良県", "高市郡明日香村"},
+		{"山形県西村山郡河北町谷地戊81", "山形県", "西村山郡河北町"},
+		{"奈良県大和郡山市北郡山町248-4", "奈良県", "大和郡山市"},
+		{"福岡県小郡市小郡255-1", "福岡県", "小郡市"},
+		{"福島県郡山市朝日1-23-7", "福島県", "郡山市"},
+		{"大阪府大阪市北区梅田1-1", "大阪府", "大阪市"},
+		{"住所不定", "", ""},
+		{"東京都", "東京都", ""},
+	} {
+		prefecture, city := parseAddress(tc.address)
+		if prefecture != tc.prefecture || city != tc.city {
+			t.Errorf("parseAddress(%q) = %q, %q, want %q, %q", tc.address, prefecture, city, tc.prefecture, tc.city)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// hmacAuthScheme 署名付きリクエストの Authorization ヘッダのスキーム
+// Authorization: ISUUMO-HMAC-SHA256 keyId=<id>, timestamp=<unix秒>, nonce=<nonce>, signature=<hex>
+const hmacAuthScheme = "ISUUMO-HMAC-SHA256"
+
+const adminKeyIDContextKey = "adminKeyID"
+
+// adminRoutes 管理者の認証が必要なルート。/debug/ と /admin/ 以下は追加したルートも含めてすべて対象にする
+var adminRoutes = map[string]bool{
+	"POST /initialize":            true,
+	"POST /api/chair":             true,
+	"POST /api/estate":            true,
+	"POST /api/estate/status/:id": true,
+	"GET /api/import/:jobId":      true,
+	"GET /metrics":                true,
+}
+
+var adminRoutePrefixes = []string{"/debug/", "/admin/"}
+
+func isAdminRoute(method, path string) bool {
+	if adminRoutes[method+" "+path] {
+		return true
+	}
+	for _, prefix := range adminRoutePrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminAuth 管理用のルートを API キーか HMAC 署名で認証し、認証した更新を監査ログに残す
+type AdminAuth struct {
+	keys    map[string][]byte // キーID -> 秘密鍵
+	maxSkew time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // キーIDとnonce -> 期限
+	pruned time.Time
+
+	auditMu sync.Mutex
+	audit   *os.File
+
+	results sync.Map // string -> *int64
+}
+
+// AdminAuditEntry 認証した更新リクエスト1件分の監査ログ
+type AdminAuditEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	KeyID     string  `json:"key_id"`
+	Auth      string  `json:"auth"`
+	Method    string  `json:"method"`
+	Route     string  `json:"route"`
+	URI       string  `json:"uri"`
+	Status    int     `json:"status"`
+	Latency   float64 `json:"latency"`
+	RemoteIP  string  `json:"remote_ip"`
+}
+
+var adminAuth *AdminAuth
+
+// LoadAdminAuth keysFile が空なら nil を返す。1行に "キーID 秘密鍵" を書き、空行と#で始まる行は無視する
+func LoadAdminAuth(keysFile, auditLogFile string, maxSkew time.Duration) (*AdminAuth, error) {
+	if keysFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys, err := readAdminKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", keysFile, err)
+	}
+	a := &AdminAuth{keys: keys, maxSkew: maxSkew, nonces: map[string]time.Time{}}
+	if auditLogFile != "" {
+		a.audit, err = os.OpenFile(auditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func readAdminKeys(r io.Reader) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"<keyId> <secret>\"", n)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key id %q", n, fields[0])
+		}
+		keys[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return keys, nil
+}
+
+// authenticate 認証できたキーIDと方式を返す。失敗した場合は理由をエラーで返す
+func (a *AdminAuth) authenticate(req *http.Request) (keyID, method string, err error) {
+	h := req.Header.Get(echo.HeaderAuthorization)
+	switch {
+	case strings.HasPrefix(h, "Bearer "):
+		keyID, err = a.verifyAPIKey(strings.TrimSpace(h[len("Bearer "):]))
+		return keyID, "api_key", err
+	case strings.HasPrefix(h, hmacAuthScheme+" "):
+		keyID, err = a.verifySignature(req, h[len(hmacAuthScheme)+1:], time.Now())
+		return keyID, "hmac", err
+	}
+	return "", "", fmt.Errorf("missing credentials")
+}
+
+// verifyAPIKey 秘密鍵そのものを渡す方式。どのキーと一致したかで時間が変わらないよう全キーと比べる
+func (a *AdminAuth) verifyAPIKey(secret string) (string, error) {
+	matched := ""
+	for id, key := range a.keys {
+		if hmac.Equal(key, []byte(secret)) {
+			matched = id
+		}
+	}
+	if matched == "" {
+		return "", fmt.Errorf("invalid api key")
+	}
+	return matched, nil
+}
+
+// verifySignature 署名の対象は メソッド, リクエストURI, timestamp, nonce, ボディのSHA-256 を改行でつないだもの
+// timestamp が maxSkew 以上ずれているものと、期限内に同じ nonce を使ったものは拒否する
+func (a *AdminAuth) verifySignature(req *http.Request, params string, now time.Time) (string, error) {
+	p := map[string]string{}
+	for _, kv := range strings.Split(params, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return "", fmt.Errorf("malformed authorization parameter %q", strings.TrimSpace(kv))
+		}
+		p[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	keyID, nonce := p["keyId"], p["nonce"]
+	// 存在するキーIDを探れないよう、知らないキーIDでも署名まで計算して同じエラーを返す
+	key, known := a.keys[keyID]
+	if nonce == "" {
+		return "", fmt.Errorf("missing nonce")
+	}
+	ts, err := strconv.ParseInt(p["timestamp"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp")
+	}
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew < -a.maxSkew || skew > a.maxSkew {
+		return "", fmt.Errorf("timestamp is out of range")
+	}
+	sig, err := hex.DecodeString(p["signature"])
+	if err != nil {
+		return "", errInvalidSignature
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal(sig, signRequest(key, req.Method, req.RequestURI, p["timestamp"], nonce, body)) || !known {
+		return "", errInvalidSignature
+	}
+	if !a.useNonce(keyID+"\x00"+nonce, now) {
+		return "", fmt.Errorf("nonce already used")
+	}
+	return keyID, nil
+}
+
+var errInvalidSignature = fmt.Errorf("invalid signature")
+
+// signRequest クライアントと同じ手順で署名を計算する
+func signRequest(key []byte, method, uri, timestamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])))
+	return mac.Sum(nil)
+}
+
+// useNonce timestamp の許容範囲を過ぎた nonce は再送されても timestamp で拒否できるため、その時点で忘れる
+func (a *AdminAuth) useNonce(nonce string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.pruned) > a.maxSkew {
+		for n, expire := range a.nonces {
+			if now.After(expire) {
+				delete(a.nonces, n)
+			}
+		}
+		a.pruned = now
+	}
+	if expire, ok := a.nonces[nonce]; ok && !now.After(expire) {
+		return false
+	}
+	a.nonces[nonce] = now.Add(2 * a.maxSkew)
+	return true
+}
+
+func (a *AdminAuth) count(result string) {
+	v, _ := a.results.LoadOrStore(result, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// Results メトリクス用に認証の結果ごとの件数を返す
+func (a *AdminAuth) Results() map[string]int64 {
+	m := map[string]int64{}
+	a.results.Range(func(k, v interface{}) bool {
+		m[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return m
+}
+
+func (a *AdminAuth) writeAudit(entry AdminAuditEntry) {
+	if a.audit == nil {
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+	a.audit.Write(append(b, '\n'))
+}
+
+func (a *AdminAuth) Close() error {
+	if a.audit != nil {
+		return a.audit.Close()
+	}
+	return nil
+}
+
+func (a *AdminAuth) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !isAdminRoute(req.Method, c.Path()) {
+			return next(c)
+		}
+		keyID, method, err := a.authenticate(req)
+		if err != nil {
+			a.count("rejected")
+			c.Echo().Logger.Infof("admin auth failed for %v %v : %v", req.Method, c.Path(), err)
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, hmacAuthScheme)
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		a.count("ok")
+		c.Set(adminKeyIDContextKey, keyID)
+
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			return next(c)
+		}
+		start := time.Now()
+		err = next(c)
+		if err != nil {
+			c.Error(err)
+		}
+		a.writeAudit(AdminAuditEntry{
+			Time:      start.Format(time.RFC3339Nano),
+			RequestID: requestID(c),
+			KeyID:     keyID,
+			Auth:      method,
+			Method:    req.Method,
+			Route:     c.Path(),
+			URI:       req.RequestURI,
+			Status:    c.Response().Status,
+			Latency:   time.Since(start).Seconds(),
+			RemoteIP:  c.RealIP(),
+		})
+		return nil
+	}
+}
+
+// denyAdminRoutes 管理者のキーを設定していなければ、管理用のルートは誰も認証できないものとして拒否する
+func denyAdminRoutes(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !isAdminRoute(req.Method, c.Path()) {
+			return next(c)
+		}
+		c.Echo().Logger.Infof("admin route %v %v refused : admin keys are not configured", req.Method, c.Path())
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, hmacAuthScheme)
+		return c.NoContent(http.StatusUnauthorized)
+	}
+}
+
+// adminKeyID 管理者として認証したリクエストならキーIDを返す
+func adminKeyID(c echo.Context) string {
+	id, _ := c.Get(adminKeyIDContextKey).(string)
+	return id
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func testAdminAuth() *AdminAuth {
+	return &AdminAuth{
+		keys:    map[string][]byte{"ops": []byte("s3cret")},
+		maxSkew: 5 * time.Minute,
+		nonces:  map[string]time.Time{},
+	}
+}
+
+// signedRequest クライアントと同じ手順で署名した Authorization ヘッダ付きのリクエストを作る
+func signedRequest(keyID string, key []byte, method, uri, body, nonce string, ts time.Time) *http.Request {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	sig := hex.EncodeToString(signRequest(key, method, uri, timestamp, nonce, []byte(body)))
+	req.Header.Set(echo.HeaderAuthorization, hmacAuthScheme+" keyId="+keyID+", timestamp="+timestamp+", nonce="+nonce+", signature="+sig)
+	return req
+}
+
+func Test_VerifySignature(t *testing.T) {
+	a := testAdminAuth()
+	now := time.Now()
+	key := []byte("s3cret")
+
+	req := signedRequest("ops", key, http.MethodPost, "/api/chair", "1,椅子", "n1", now)
+	keyID, method, err := a.authenticate(req)
+	if err != nil || keyID != "ops" || method != "hmac" {
+		t.Fatalf("authenticate = %q, %q, %v", keyID, method, err)
+	}
+	// 署名の検証でボディを読んでもハンドラから読み直せる
+	if body, err := ioutil.ReadAll(req.Body); err != nil || string(body) != "1,椅子" {
+		t.Errorf("body = %q, %v", body, err)
+	}
+
+	for name, req := range map[string]*http.Request{
+		"replayed nonce": signedRequest("ops", key, http.MethodPost, "/api/chair", "1,椅子", "n1", now),
+		"wrong key":      signedRequest("ops", []byte("guess"), http.MethodPost, "/api/chair", "", "n2", now),
+		"unknown key id": signedRequest("nobody", key, http.MethodPost, "/api/chair", "", "n3", now),
+		"stale":          signedRequest("ops", key, http.MethodPost, "/api/chair", "", "n4", now.Add(-10*time.Minute)),
+		"future":         signedRequest("ops", key, http.MethodPost, "/api/chair", "", "n5", now.Add(10*time.Minute)),
+	} {
+		if _, _, err := a.authenticate(req); err == nil {
+			t.Errorf("%v: request must be rejected", name)
+		}
+	}
+
+	// 署名の改ざん先が別のパスやボディでも通らない
+	req = signedRequest("ops", key, http.MethodPost, "/api/chair", "1,椅子", "n6", now)
+	req.RequestURI = "/api/estate"
+	if _, _, err := a.authenticate(req); err == nil {
+		t.Errorf("a signature for another URI must be rejected")
+	}
+}
+
+// 存在しないキーIDでも、署名の誤りと同じエラーしか返さない
+func Test_VerifySignatureDoesNotRevealKeyIDs(t *testing.T) {
+	a := testAdminAuth()
+	now := time.Now()
+	_, _, unknown := a.authenticate(signedRequest("nobody", []byte("s3cret"), http.MethodPost, "/initialize", "", "n1", now))
+	_, _, mismatch := a.authenticate(signedRequest("ops", []byte("guess"), http.MethodPost, "/initialize", "", "n2", now))
+	if unknown == nil || mismatch == nil || unknown.Error() != mismatch.Error() {
+		t.Errorf("unknown key id error %q differs from signature mismatch %q", unknown, mismatch)
+	}
+}
+
+func Test_UseNonce(t *testing.T) {
+	a := testAdminAuth()
+	now := time.Now()
+	if !a.useNonce("ops\x00n1", now) {
+		t.Fatal("a new nonce must be accepted")
+	}
+	if a.useNonce("ops\x00n1", now.Add(time.Minute)) {
+		t.Errorf("a nonce must not be accepted twice within its lifetime")
+	}
+	if !a.useNonce("other\x00n1", now) {
+		t.Errorf("nonces are scoped by key id")
+	}
+	// timestamp の許容範囲を過ぎた nonce は忘れて、記録が増え続けないようにする
+	later := now.Add(2*a.maxSkew + time.Second)
+	if !a.useNonce("ops\x00n2", later) {
+		t.Fatal("a new nonce must be accepted")
+	}
+	if _, ok := a.nonces["ops\x00n1"]; ok {
+		t.Errorf("expired nonces must be pruned")
+	}
+	if !a.useNonce("ops\x00n1", later) {
+		t.Errorf("an expired nonce is rejected by its timestamp instead")
+	}
+}
+
+func Test_VerifyAPIKey(t *testing.T) {
+	a := testAdminAuth()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer s3cret")
+	if keyID, method, err := a.authenticate(req); err != nil || keyID != "ops" || method != "api_key" {
+		t.Errorf("authenticate = %q, %q, %v", keyID, method, err)
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer wrong")
+	if _, _, err := a.authenticate(req); err == nil {
+		t.Errorf("a wrong api key must be rejected")
+	}
+}
+
+func Test_ReadAdminKeys(t *testing.T) {
+	keys, err := readAdminKeys(strings.NewReader("# comment\n\nops s3cret\nci  other \n"))
+	if err != nil || len(keys) != 2 || string(keys["ci"]) != "other" {
+		t.Errorf("keys = %v, %v", keys, err)
+	}
+	for _, in := range []string{"", "# only comments\n", "ops\n", "ops a\nops b\n"} {
+		if _, err := readAdminKeys(strings.NewReader(in)); err == nil {
+			t.Errorf("readAdminKeys(%q) must fail", in)
+		}
+	}
+}
+
+func Test_AdminRoutesFailClosed(t *testing.T) {
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.Use(denyAdminRoutes)
+	e.POST("/initialize", ok)
+	e.GET("/debug/config", ok)
+	e.GET("/api/chair/:id", ok)
+
+	for path, want := range map[string]int{
+		"POST /initialize":  http.StatusUnauthorized,
+		"GET /debug/config": http.StatusUnauthorized,
+		"GET /api/chair/1":  http.StatusOK,
+	} {
+		parts := strings.SplitN(path, " ", 2)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(parts[0], parts[1], nil))
+		if rec.Code != want {
+			t.Errorf("%v = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func Test_AdminMiddlewareRejectsUnauthenticated(t *testing.T) {
+	a := testAdminAuth()
+	e := echo.New()
+	e.Use(a.Middleware)
+	e.POST("/initialize", func(c echo.Context) error {
+		if adminKeyID(c) != "ops" {
+			t.Errorf("key id = %q", adminKeyID(c))
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/initialize", nil))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get(echo.HeaderWWWAuthenticate) != hmacAuthScheme {
+		t.Errorf("unauthenticated = %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, signedRequest("ops", []byte("s3cret"), http.MethodPost, "/initialize", "", "n1", time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Errorf("signed = %d", rec.Code)
+	}
+	if got := a.Results(); got["ok"] != 1 || got["rejected"] != 1 {
+		t.Errorf("results = %v", got)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// BatchDetailLimit 一度に取得できる詳細の件数の上限
+const BatchDetailLimit = 100
+
+// batchJSON {"<key>":[...],"missingIds":[...]} の形で断片をつなげる
+func batchJSON(key string, n int, frag func(i int) ([]byte, error), missing []int64) ([]byte, error) {
+	b, err := listJSON(key, false, 0, n, frag)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b[:len(b)-1], `,"missingIds":[`...)
+	for i, id := range missing {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, id, 10)
+	}
+	return append(b, "]}"...), nil
+}
+
+// parseIDs カンマ区切りのIDを重複を除いて指定された順に返す
+func parseIDs(s string) ([]int64, error) {
+	if s == "" {
+		return nil, fmt.Errorf("ids is empty")
+	}
+	parts := strings.Split(s, ",")
+	ids := make([]int64, 0, len(parts))
+	seen := make(map[int64]bool, len(parts))
+	for _, p := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) > BatchDetailLimit {
+		return nil, fmt.Errorf("too many ids: %d", len(ids))
+	}
+	return ids, nil
+}
+
+func getChairs(c echo.Context) error {
+	ids, err := parseIDs(c.QueryParam("ids"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"ids\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	groups := dbChair.groupIDs(ids)
+	lists := make([][]Chair, len(groups))
+	err = dbChair.scatter(c.Request().Context(), func(ctx context.Context, i int, shard *Cluster) error {
+		if len(groups[i]) == 0 {
+			return nil
+		}
+		query, params, err := sqlx.In("SELECT * FROM chair WHERE id IN (?)", groups[i])
+		if err != nil {
+			return err
+		}
+		return shard.SelectContext(ctx, &lists[i], query, params...)
+	})
+	if err != nil {
+		c.Echo().Logger.Errorf("getChairs DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	found := make(map[int64]Chair, len(ids))
+	for _, chairs := range lists {
+		for _, chair := range chairs {
+			found[chair.ID] = chair
+		}
+	}
+	chairs, missing := make([]Chair, 0, len(ids)), []int64{}
+	for _, id := range ids {
+		// 売り切れた椅子は getChairDetail と同様に見つからなかったものとして扱う
+		chair, ok := found[id]
+		if !ok || currentStock(chair) <= 0 {
+			missing = append(missing, id)
+			continue
+		}
+		chairs = append(chairs, chair)
+	}
+
+	return fragmentResponse(c, func() ([]byte, error) {
+		return batchJSON("chairs", len(chairs), func(i int) ([]byte, error) {
+			return chairs[i].fragment()
+		}, missing)
+	})
+}
+
+func getEstates(c echo.Context) error {
+	ids, err := parseIDs(c.QueryParam("ids"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"ids\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	query, params, err := sqlx.In("SELECT * FROM estate WHERE id IN (?)", ids)
+	if err != nil {
+		c.Echo().Logger.Errorf("getEstates failed to build query : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	estates := []Estate{}
+	err = dbEstate.SelectContext(c.Request().Context(), &estates, query, params...)
+	if err != nil {
+		c.Echo().Logger.Errorf("getEstates DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	found := make(map[int64]Estate, len(estates))
+	for _, estate := range estates {
+		found[estate.ID] = estate
+	}
+	listed, missing := make([]Estate, 0, len(ids)), []int64{}
+	for _, id := range ids {
+		estate, ok := found[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		listed = append(listed, estate)
+	}
+
+	return fragmentResponse(c, func() ([]byte, error) {
+		return batchJSON("estates", len(listed), func(i int) ([]byte, error) {
+			return listed[i].fragment()
+		}, missing)
+	})
+}
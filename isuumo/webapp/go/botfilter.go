@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo"
+)
+
+type botRule struct {
+	pattern *regexp.Regexp
+	blocked int64
+}
+
+// BotFilter User-Agent がルールのいずれかに一致するリクエストを 503 で返す
+type BotFilter struct {
+	// combined 全ルールを1つにまとめた正規表現。一致しない大半のリクエストはこれだけで判定する
+	combined *regexp.Regexp
+	rules    []*botRule
+}
+
+type BotRuleStat struct {
+	Pattern string `json:"pattern"`
+	Blocked int64  `json:"blocked"`
+}
+
+var botFilter *BotFilter
+
+func NewBotFilter(patterns []string) (*BotFilter, error) {
+	f := &BotFilter{rules: make([]*botRule, 0, len(patterns))}
+	if len(patterns) == 0 {
+		return f, nil
+	}
+	groups := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bot rule %q: %v", p, err)
+		}
+		f.rules = append(f.rules, &botRule{pattern: re})
+		groups = append(groups, "(?:"+p+")")
+	}
+	combined, err := regexp.Compile(strings.Join(groups, "|"))
+	if err != nil {
+		return nil, err
+	}
+	f.combined = combined
+	return f, nil
+}
+
+// LoadBotFilter 1行に1つ正規表現を書いたファイルからルールを読み込む。空行と#で始まる行は無視する
+func LoadBotFilter(path string) (*BotFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readBotFilter(file)
+}
+
+func readBotFilter(r io.Reader) (*BotFilter, error) {
+	patterns := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewBotFilter(patterns)
+}
+
+// match User-Agent に一致したルールを返す。一致しなければnil
+func (f *BotFilter) match(ua string) *botRule {
+	if f.combined == nil || !f.combined.MatchString(ua) {
+		return nil
+	}
+	for _, rule := range f.rules {
+		if rule.pattern.MatchString(ua) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (f *BotFilter) IsBot(ua string) bool {
+	return f.match(ua) != nil
+}
+
+func (f *BotFilter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if rule := f.match(c.Request().UserAgent()); rule != nil {
+			atomic.AddInt64(&rule.blocked, 1)
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+		return next(c)
+	}
+}
+
+// Stats ルールごとにブロックしたリクエスト数を返す
+func (f *BotFilter) Stats() []BotRuleStat {
+	stats := make([]BotRuleStat, 0, len(f.rules))
+	for _, rule := range f.rules {
+		stats = append(stats, BotRuleStat{
+			Pattern: rule.pattern.String(),
+			Blocked: atomic.LoadInt64(&rule.blocked),
+		})
+	}
+	return stats
+}
+
+func getBotFilterStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, botFilter.Stats())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+const testUUID = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+// bench/client/useragent.go の GenerateUserAgent が生成しうる User-Agent
+func normalUserAgents() []string {
+	browsers := []string{"ISUCON Nickel", "ISUCON Icetanuki", "ISUCON Web Browser", "ISUCON Explorer", "ISUCON Edge"}
+	suffixes := []string{" mobile", " bottle", " alpha", " beta", ""}
+	uas := []string{}
+	for _, browser := range browsers {
+		for _, suffix := range suffixes {
+			uas = append(uas, fmt.Sprintf("%v%v-%v", browser, suffix, testUUID))
+		}
+	}
+	return uas
+}
+
+// bench/client/useragent.go の GenerateBotUserAgent が生成しうる User-Agent
+func botUserAgents() []string {
+	uas := []string{
+		fmt.Sprintf("ISUCONbot-Mobile-%v", testUUID),
+		fmt.Sprintf("ISUCONbot-%v", testUUID),
+		fmt.Sprintf("ISUCONbot-Image/%v", testUUID),
+		fmt.Sprintf("Mediapartners-ISUCON-%v", testUUID),
+		fmt.Sprintf("%v-ISUCONCoffee", testUUID),
+		fmt.Sprintf("%v-ISUCONFeedSeekerBeta", testUUID),
+		fmt.Sprintf("%v-ISUCONFeedSeeker", testUUID),
+		fmt.Sprintf("crawler (https://isucon.invalid/support/faq/) %v", testUUID),
+		fmt.Sprintf("crawler (https://isucon.invalid/help/jp/) %v", testUUID),
+		fmt.Sprintf("isubot-%v", testUUID),
+		fmt.Sprintf("Isupider-%v", testUUID),
+		fmt.Sprintf("Isupider-image+%v", testUUID),
+		fmt.Sprintf("Isupider+%v", testUUID),
+	}
+	words := []string{"bot", "Bot", "BOT", "crawler", "Crawler", "CRAWLER", "spider", "Spider", "SPIDER"}
+	for _, word := range words {
+		for _, sep := range []string{"-", "_", " ", ".", "/", ";", "@"} {
+			uas = append(uas, fmt.Sprintf("%v%v%v", word, sep, testUUID))
+		}
+		uas = append(uas,
+			fmt.Sprintf("%v(%v)", word, testUUID),
+			fmt.Sprintf("(%v) %v", word, testUUID),
+			fmt.Sprintf("%v %v", testUUID, word),
+		)
+	}
+	return uas
+}
+
+func loadTestBotFilter(t *testing.T) *BotFilter {
+	f, err := LoadBotFilter("bot_rules.txt")
+	if err != nil {
+		t.Fatalf("failed to load bot rules: %v", err)
+	}
+	return f
+}
+
+func Test_BotFilterNormalUserAgent(t *testing.T) {
+	f := loadTestBotFilter(t)
+	for _, ua := range normalUserAgents() {
+		if f.IsBot(ua) {
+			t.Errorf("normal User Agent was classified as bot: %v", ua)
+		}
+	}
+}
+
+func Test_BotFilterBotUserAgent(t *testing.T) {
+	f := loadTestBotFilter(t)
+	for _, ua := range botUserAgents() {
+		if !f.IsBot(ua) {
+			t.Errorf("bot User Agent was not classified as bot: %v", ua)
+		}
+	}
+}
+
+func Test_BotFilterMiddleware(t *testing.T) {
+	f := loadTestBotFilter(t)
+	e := echo.New()
+	handler := f.Middleware(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	tests := []struct {
+		ua   string
+		code int
+	}{
+		{ua: normalUserAgents()[0], code: http.StatusOK},
+		{ua: fmt.Sprintf("isubot-%v", testUUID), code: http.StatusServiceUnavailable},
+		{ua: fmt.Sprintf("isubot-%v", testUUID), code: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/estate/low_priced", nil)
+		req.Header.Set("User-Agent", tt.ua)
+		rec := httptest.NewRecorder()
+		if err := handler(e.NewContext(req, rec)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Code != tt.code {
+			t.Errorf("User Agent %v: expected status %d, got %d", tt.ua, tt.code, rec.Code)
+		}
+	}
+
+	for _, stat := range f.Stats() {
+		expected := int64(0)
+		if stat.Pattern == "isubot" {
+			expected = 2
+		}
+		if stat.Blocked != expected {
+			t.Errorf("rule %v: expected %d blocked requests, got %d", stat.Pattern, expected, stat.Blocked)
+		}
+	}
+}
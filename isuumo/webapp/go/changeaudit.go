@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 変更の種類
+const (
+	ChangeImport       = "import"
+	ChangePurchase     = "purchase"
+	ChangeUpdate       = "update"
+	ChangeStatusChange = "status_change"
+	ChangeReset        = "reset"
+)
+
+// changeActorSystem リクエストによらない補完などの変更
+const changeActorSystem = "system"
+
+const (
+	defaultChangeAuditLimit = 100
+	maxChangeAuditLimit     = 1000
+)
+
+// ChangeAuditEntry 椅子や物件の1件の変更。ListingID が0のものは /initialize のように種類全体への変更
+type ChangeAuditEntry struct {
+	Time      time.Time              `json:"time"`
+	RequestID string                 `json:"requestId,omitempty"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Kind      string                 `json:"kind"`
+	ListingID int64                  `json:"listingId,omitempty"`
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after,omitempty"`
+}
+
+// auditMarkInterval 時刻で検索するときに読み始める位置を、このバイト数ごとに覚えておく
+const auditMarkInterval = 256 * 1024
+
+// ChangeAudit 在庫や物件の変更を1行1JSONで追記する。記録した変更は書き換えない
+// maxBytes を超えたファイルは path.1, path.2 ... と古いものほど大きい番号に回してすべて残す
+// maxFiles を指定したときだけ、書き込み中のものを含めてそれを超えた古いファイルを消す
+type ChangeAudit struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	maxBytes int64
+	maxFiles int
+	// segments 古い順のファイル。最後が書き込み中のもの
+	segments []*auditSegment
+	// key 購入者のメールアドレスを仮名にするための鍵。監査ログと同じ場所の .key に保存し、再起動しても同じ仮名にする
+	key []byte
+}
+
+// auditSegment 1つのファイルに含まれる変更の時刻の範囲と、読み始める位置の索引
+type auditSegment struct {
+	path     string
+	size     int64
+	min, max time.Time
+	marks    []auditMark
+}
+
+// auditMark offset より前の変更はすべて maxBefore 以前の時刻を持つ
+type auditMark struct {
+	offset    int64
+	maxBefore time.Time
+}
+
+// add 1行分の変更を範囲と索引に反映する
+func (s *auditSegment) add(t time.Time, n int64) {
+	if s.size >= s.nextMark() {
+		s.marks = append(s.marks, auditMark{offset: s.size, maxBefore: s.max})
+	}
+	if s.min.IsZero() || t.Before(s.min) {
+		s.min = t
+	}
+	if t.After(s.max) {
+		s.max = t
+	}
+	s.size += n
+}
+
+func (s *auditSegment) nextMark() int64 {
+	if len(s.marks) == 0 {
+		return auditMarkInterval
+	}
+	return s.marks[len(s.marks)-1].offset + auditMarkInterval
+}
+
+// startOffset from より前の変更しかない部分を読み飛ばせる位置
+func (s *auditSegment) startOffset(from time.Time) int64 {
+	offset := int64(0)
+	for _, m := range s.marks {
+		if !m.maxBefore.Before(from) {
+			break
+		}
+		offset = m.offset
+	}
+	return offset
+}
+
+// scanAuditSegment 起動時に既存のファイルの時刻の範囲と索引を作る
+func scanAuditSegment(path string) (*auditSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seg := &auditSegment{path: path}
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var e struct {
+				Time time.Time `json:"time"`
+			}
+			json.Unmarshal(line, &e)
+			seg.add(e.Time, int64(len(line)))
+		}
+		if err == io.EOF {
+			return seg, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+var changeAudit *ChangeAudit
+
+// NewChangeAudit path が空なら変更を記録しない。maxBytes が0ならファイルを回さない。maxFiles が0なら古いファイルを消さない
+func NewChangeAudit(path string, maxBytes int64, maxFiles int) (*ChangeAudit, error) {
+	if path == "" {
+		return nil, nil
+	}
+	key, err := loadPseudonymKey(path + ".key")
+	if err != nil {
+		return nil, err
+	}
+	a := &ChangeAudit{path: path, maxBytes: maxBytes, maxFiles: maxFiles, key: key}
+	var rotated []*auditSegment
+	for i := 1; ; i++ {
+		seg, err := scanAuditSegment(a.rotatedPath(i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rotated = append(rotated, seg)
+	}
+	// 番号の大きいものほど古い
+	for i := len(rotated) - 1; i >= 0; i-- {
+		a.segments = append(a.segments, rotated[i])
+	}
+	a.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := scanAuditSegment(path)
+	if err != nil {
+		a.f.Close()
+		return nil, err
+	}
+	a.segments = append(a.segments, seg)
+	return a, nil
+}
+
+func (a *ChangeAudit) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// rotate 呼び出し側でロックを持ったまま、書き込み中のファイルを path.1 にして新しいファイルを開く
+func (a *ChangeAudit) rotate() error {
+	for a.maxFiles > 0 && len(a.segments) >= a.maxFiles {
+		if err := os.Remove(a.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		a.segments = a.segments[1:]
+	}
+	rotated := len(a.segments) - 1
+	for i, seg := range a.segments[:rotated] {
+		next := a.rotatedPath(rotated - i + 1)
+		if err := os.Rename(seg.path, next); err != nil {
+			return err
+		}
+		seg.path = next
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	active := a.segments[rotated]
+	if err := os.Rename(a.path, a.rotatedPath(1)); err != nil {
+		return err
+	}
+	active.path = a.rotatedPath(1)
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.f = f
+	a.segments = append(a.segments, &auditSegment{path: a.path})
+	return nil
+}
+
+// loadPseudonymKey 鍵のファイルがなければ作る
+func loadPseudonymKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) < 16 {
+			return nil, fmt.Errorf("%v: key is too short", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// userActor 購入者をメールアドレスのまま残さず、同じ購入者なら同じになる仮名にする
+func (a *ChangeAudit) userActor(email string) string {
+	if a == nil {
+		return "user"
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(email))
+	return "user:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// record 記録しない設定の場合は何もしない。時刻が未設定のものには現在時刻を入れる
+func (a *ChangeAudit) record(entries ...ChangeAuditEntry) {
+	if a == nil || len(entries) == 0 {
+		return
+	}
+	now := time.Now()
+	lines := make([][]byte, 0, len(entries))
+	times := make([]time.Time, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Time.IsZero() {
+			entry.Time = now
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, append(b, '\n'))
+		times = append(times, entry.Time)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, line := range lines {
+		seg := a.segments[len(a.segments)-1]
+		if _, err := a.f.Write(line); err != nil {
+			return
+		}
+		seg.add(times[i], int64(len(line)))
+		if a.maxBytes > 0 && seg.size >= a.maxBytes {
+			if err := a.rotate(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ChangeAuditQuery kind, listingID が空や0なら絞り込まない。listingID を指定した場合も種類全体への変更は含める
+type ChangeAuditQuery struct {
+	Kind      string
+	ListingID int64
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+func (q ChangeAuditQuery) match(e ChangeAuditEntry) bool {
+	if q.Kind != "" && e.Kind != q.Kind {
+		return false
+	}
+	if q.ListingID != 0 && e.ListingID != 0 && e.ListingID != q.ListingID {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// overlaps ファイル内の変更の時刻の範囲が検索する範囲と重なるか
+func (q ChangeAuditQuery) overlaps(seg *auditSegment) bool {
+	if seg.size == 0 {
+		return false
+	}
+	if !q.From.IsZero() && seg.max.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !seg.min.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// auditRange 開いたファイルのうち読む範囲
+type auditRange struct {
+	f          *os.File
+	start, end int64
+}
+
+// Query 条件に合う変更のうち新しいものから Limit 件を古い順に返す
+// 時刻の範囲が重ならないファイルは開かず、from より前の部分は索引を使って読み飛ばす
+func (a *ChangeAudit) Query(q ChangeAuditQuery) ([]ChangeAuditEntry, error) {
+	// 回している最中に別のファイルを開かないよう、ロックを持ったまま開いて読む範囲を決める
+	ranges := []auditRange{}
+	a.mu.Lock()
+	for _, seg := range a.segments {
+		if !q.overlaps(seg) {
+			continue
+		}
+		f, err := os.Open(seg.path)
+		if err != nil {
+			a.mu.Unlock()
+			for _, r := range ranges {
+				r.f.Close()
+			}
+			return nil, err
+		}
+		ranges = append(ranges, auditRange{f: f, start: seg.startOffset(q.From), end: seg.size})
+	}
+	a.mu.Unlock()
+	defer func() {
+		for _, r := range ranges {
+			r.f.Close()
+		}
+	}()
+
+	entries := []ChangeAuditEntry{}
+	for _, r := range ranges {
+		scanner := bufio.NewScanner(io.NewSectionReader(r.f, r.start, r.end-r.start))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e ChangeAuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if !q.match(e) {
+				continue
+			}
+			entries = append(entries, e)
+			if len(entries) > q.Limit {
+				entries = entries[1:]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (a *ChangeAudit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// changeActor 管理者として認証していればキーID、していなければ anonymous とする
+func changeActor(c echo.Context) string {
+	if id := adminKeyID(c); id != "" {
+		return "admin:" + id
+	}
+	return "anonymous"
+}
+
+// importChanges 投入した行をそれぞれ1件の変更として記録する
+func importChanges(kind, actor, requestID string, rows []map[string]interface{}) []ChangeAuditEntry {
+	entries := make([]ChangeAuditEntry, 0, len(rows))
+	for _, row := range rows {
+		entries = append(entries, ChangeAuditEntry{
+			RequestID: requestID,
+			Actor:     actor,
+			Action:    ChangeImport,
+			Kind:      kind,
+			ListingID: int64(row["id"].(int)),
+			After:     row,
+		})
+	}
+	return entries
+}
+
+// getChangeAudit GET /admin/audit/changes?kind=chair&id=1&from=<RFC3339>&to=<RFC3339>&limit=100
+func getChangeAudit(c echo.Context) error {
+	if changeAudit == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if adminAuth == nil {
+		c.Echo().Logger.Infof("refused to serve change audit : admin auth is not configured")
+		return c.NoContent(http.StatusForbidden)
+	}
+	q := ChangeAuditQuery{Kind: c.QueryParam("kind"), Limit: defaultChangeAuditLimit}
+	if q.Kind != "" && q.Kind != listingKindChair && q.Kind != listingKindEstate {
+		c.Echo().Logger.Infof("invalid audit kind : %v", q.Kind)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	var err error
+	if v := c.QueryParam("id"); v != "" {
+		if q.ListingID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			c.Echo().Logger.Infof("invalid audit id : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+	for param, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := c.QueryParam(param); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				c.Echo().Logger.Infof("invalid audit %v : %v", param, err)
+				return c.NoContent(http.StatusBadRequest)
+			}
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 || q.Limit > maxChangeAuditLimit {
+			c.Echo().Logger.Infof("invalid audit limit : %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	entries, err := changeAudit.Query(q)
+	if err != nil {
+		c.Logger().Errorf("failed to read change audit : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, map[string][]ChangeAuditEntry{"entries": entries})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ChangeAuditRotatesAndQueriesByTime(t *testing.T) {
+	path := filepath.Join(tempDir(t), "change_audit.jsonl")
+	a, err := NewChangeAudit(path, 4096, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2020, 9, 12, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 200; i++ {
+		a.record(ChangeAuditEntry{
+			Time:      base.Add(time.Duration(i) * time.Second),
+			Actor:     changeActorSystem,
+			Action:    ChangePurchase,
+			Kind:      listingKindChair,
+			ListingID: int64(i),
+			After:     map[string]interface{}{"stock": i},
+		})
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("rotated files beyond maxFiles must be removed")
+	}
+	if len(a.segments) != 3 {
+		t.Fatalf("segments = %d, want 3", len(a.segments))
+	}
+	oldest := a.segments[0].min
+
+	check := func(a *ChangeAudit) {
+		t.Helper()
+		// 最も古いファイルより前の変更は消えている
+		entries, err := a.Query(ChangeAuditQuery{Limit: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 || !entries[0].Time.Equal(oldest) || entries[len(entries)-1].ListingID != 199 {
+			t.Fatalf("entries = %d, first %v", len(entries), entries[0].Time)
+		}
+		for i := 1; i < len(entries); i++ {
+			if entries[i].ListingID != entries[i-1].ListingID+1 {
+				t.Fatalf("entries are not contiguous at %d", i)
+			}
+		}
+
+		from, to := base.Add(190*time.Second), base.Add(195*time.Second)
+		entries, err = a.Query(ChangeAuditQuery{From: from, To: to, Limit: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 5 || entries[0].ListingID != 190 || entries[4].ListingID != 194 {
+			t.Errorf("entries in [%v, %v) = %+v", from, to, entries)
+		}
+
+		entries, err = a.Query(ChangeAuditQuery{ListingID: 198, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].ListingID != 198 {
+			t.Errorf("entries for listing 198 = %+v", entries)
+		}
+	}
+	check(a)
+	a.Close()
+
+	// 開き直しても時刻の範囲を読み直して同じ結果を返す
+	reopened, err := NewChangeAudit(path, 4096, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
+
+func Test_ChangeAuditKeepsEveryRotatedFileByDefault(t *testing.T) {
+	path := filepath.Join(tempDir(t), "change_audit.jsonl")
+	a, err := NewChangeAudit(path, 4096, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2020, 9, 12, 0, 0, 0, 0, time.UTC)
+	record := func(a *ChangeAudit, from, to int) {
+		for i := from; i < to; i++ {
+			a.record(ChangeAuditEntry{
+				Time:      base.Add(time.Duration(i) * time.Second),
+				Actor:     changeActorSystem,
+				Action:    ChangePurchase,
+				Kind:      listingKindChair,
+				ListingID: int64(i + 1),
+			})
+		}
+	}
+	record(a, 0, 200)
+	if len(a.segments) < 5 {
+		t.Fatalf("segments = %d, want the log to have rotated several times", len(a.segments))
+	}
+	a.Close()
+
+	// 開き直した後も、回したファイルをすべて読み直して続きを記録する
+	a, err = NewChangeAudit(path, 4096, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	record(a, 200, 300)
+	entries, err := a.Query(ChangeAuditQuery{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 300 {
+		t.Fatalf("entries = %d, want all 300", len(entries))
+	}
+	for i, e := range entries {
+		if e.ListingID != int64(i+1) {
+			t.Fatalf("entry %d is listing %d", i, e.ListingID)
+		}
+	}
+}
+
+func Test_AuditSegmentStartOffset(t *testing.T) {
+	base := time.Date(2020, 9, 12, 0, 0, 0, 0, time.UTC)
+	seg := &auditSegment{}
+	// 1行が auditMarkInterval を超えるので、2行目以降は行ごとに索引ができる
+	for i := 0; i < 5; i++ {
+		seg.add(base.Add(time.Duration(i)*time.Minute), auditMarkInterval)
+	}
+	for _, tc := range []struct {
+		from time.Time
+		want int64
+	}{
+		{time.Time{}, 0},
+		{base, 0},
+		{base.Add(90 * time.Second), 2 * auditMarkInterval},
+		{base.Add(10 * time.Minute), 4 * auditMarkInterval},
+	} {
+		if got := seg.startOffset(tc.from); got != tc.want {
+			t.Errorf("startOffset(%v) = %d, want %d", tc.from, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+// Cluster 1台のプライマリとN台のレプリカをまとめた論理的なDB
+// 参照は正常なレプリカに振り分け、更新とトランザクションはプライマリで実行する
+type Cluster struct {
+	name     string
+	primary  *DB
+	replicas []*replica
+	next     uint32
+	maxLag   time.Duration
+	done     chan struct{}
+}
+
+type replica struct {
+	db      *DB
+	healthy int32
+	lag     int64 // time.Duration
+	lastErr atomic.Value
+}
+
+type ReplicaStat struct {
+	Name    string  `json:"name"`
+	Healthy bool    `json:"healthy"`
+	LagMs   float64 `json:"lagMs"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// NewCluster レプリカはプライマリと同じ設定で接続し、定期的に遅延を確認する
+func NewCluster(name string, primary MySQLConnectionEnv, replicas []MySQLConnectionEnv, conf MySQLConfig) (*Cluster, error) {
+	db, err := primary.ConnectDB(name)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(conf.MaxOpenConns)
+	c := &Cluster{
+		name:    name,
+		primary: db,
+		maxLag:  time.Duration(conf.MaxReplicaLag),
+		done:    make(chan struct{}),
+	}
+	for i, mc := range replicas {
+		rdb, err := mc.ConnectDB(fmt.Sprintf("%s-replica-%d", name, i))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		rdb.SetMaxOpenConns(conf.MaxOpenConns)
+		c.replicas = append(c.replicas, &replica{db: rdb})
+	}
+	if len(c.replicas) > 0 {
+		c.checkReplicas()
+		go c.checkLoop(time.Duration(conf.ReplicaCheckInterval))
+	}
+	return c, nil
+}
+
+// parseReplicaHosts "host:port,host:port" 形式のレプリカの一覧を、ユーザーやDB名をプライマリから引き継いで返す
+func parseReplicaHosts(s string, primary MySQLConnectionEnv) ([]MySQLConnectionEnv, error) {
+	replicas := []MySQLConnectionEnv{}
+	for _, h := range strings.Split(s, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		mc := primary
+		mc.Host = h
+		if i := strings.LastIndex(h, ":"); i >= 0 {
+			if _, err := strconv.Atoi(h[i+1:]); err != nil {
+				return nil, fmt.Errorf("invalid replica %q", h)
+			}
+			mc.Host, mc.Port = h[:i], h[i+1:]
+		}
+		replicas = append(replicas, mc)
+	}
+	return replicas, nil
+}
+
+func (c *Cluster) checkLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkReplicas()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Cluster) checkReplicas() {
+	for _, r := range c.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), readinessPingTimeout)
+		lag, err := r.db.replicationLag(ctx)
+		cancel()
+		switch {
+		case err != nil:
+			r.markDown(err)
+		case lag > c.maxLag:
+			atomic.StoreInt64(&r.lag, int64(lag))
+			r.markDown(fmt.Errorf("replication lag %v exceeds %v", lag, c.maxLag))
+		default:
+			atomic.StoreInt64(&r.lag, int64(lag))
+			r.lastErr.Store("")
+			atomic.StoreInt32(&r.healthy, 1)
+		}
+	}
+}
+
+// replicationLag レプリケーションが止まっている場合はエラーを返す
+// SHOW SLAVE STATUS が空のサーバーはレプリカではない読み取り専用のコピーとみなし遅延を0とする
+func (db *DB) replicationLag(ctx context.Context) (time.Duration, error) {
+	row := map[string]interface{}{}
+	err := db.conn.QueryRowxContext(ctx, "SHOW SLAVE STATUS").MapScan(row)
+	if err == sql.ErrNoRows {
+		return 0, db.conn.PingContext(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, ok := row["Seconds_Behind_Master"].([]byte)
+	if !ok {
+		return 0, fmt.Errorf("replication is not running")
+	}
+	sec, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(sec) * time.Second, nil
+}
+
+func (r *replica) markDown(err error) {
+	r.lastErr.Store(err.Error())
+	atomic.StoreInt32(&r.healthy, 0)
+}
+
+// reader 参照に使うノードを選ぶ。このリクエストで更新済み、または正常なレプリカがなければプライマリを返す
+func (c *Cluster) reader(ctx context.Context) (*DB, *replica) {
+	if wroteInRequest(ctx, c) {
+		return c.primary, nil
+	}
+	n := len(c.replicas)
+	start := int(atomic.AddUint32(&c.next, 1))
+	for i := 0; i < n; i++ {
+		r := c.replicas[(start+i)%n]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r.db, r
+		}
+	}
+	return c.primary, nil
+}
+
+// isNodeFailure クエリ自体の誤りではなく、接続先のノードの障害によるエラーかを判定する
+func isNodeFailure(ctx context.Context, err error) bool {
+	if err == nil || err == sql.ErrNoRows || ctx.Err() != nil {
+		return false
+	}
+	_, ok := err.(*mysql.MySQLError)
+	return !ok
+}
+
+// read レプリカで失敗した場合はそのレプリカを切り離してプライマリで再実行する
+func (c *Cluster) read(ctx context.Context, f func(db *DB) error) error {
+	db, r := c.reader(ctx)
+	err := f(db)
+	if r != nil && isNodeFailure(ctx, err) {
+		r.markDown(err)
+		return f(c.primary)
+	}
+	return err
+}
+
+func (c *Cluster) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return c.read(ctx, func(db *DB) error {
+		return db.GetContext(ctx, dest, query, args...)
+	})
+}
+
+func (c *Cluster) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return c.read(ctx, func(db *DB) error {
+		return db.SelectContext(ctx, dest, query, args...)
+	})
+}
+
+func (c *Cluster) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	markWritten(ctx, c)
+	return c.primary.ExecContext(ctx, query, args...)
+}
+
+func (c *Cluster) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	markWritten(ctx, c)
+	return c.primary.NamedExecContext(ctx, query, arg)
+}
+
+// BeginTxx トランザクションは参照を含めてすべてプライマリで実行する
+func (c *Cluster) BeginTxx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	markWritten(ctx, c)
+	return c.primary.BeginTxx(ctx, opts)
+}
+
+func (c *Cluster) PingContext(ctx context.Context) error {
+	return c.primary.PingContext(ctx)
+}
+
+// nodes メトリクス用にプライマリとレプリカの接続をノード名で返す
+func (c *Cluster) nodes() map[string]*DB {
+	m := map[string]*DB{c.name: c.primary}
+	for _, r := range c.replicas {
+		m[r.db.name] = r.db
+	}
+	return m
+}
+
+func (c *Cluster) ReplicaStats() []ReplicaStat {
+	stats := make([]ReplicaStat, 0, len(c.replicas))
+	for _, r := range c.replicas {
+		msg, _ := r.lastErr.Load().(string)
+		stats = append(stats, ReplicaStat{
+			Name:    r.db.name,
+			Healthy: atomic.LoadInt32(&r.healthy) == 1,
+			LagMs:   float64(atomic.LoadInt64(&r.lag)) / float64(time.Millisecond),
+			Error:   msg,
+		})
+	}
+	return stats
+}
+
+func (c *Cluster) Close() error {
+	close(c.done)
+	for _, r := range c.replicas {
+		r.db.Close()
+	}
+	return c.primary.Close()
+}
+
+// ClusterStmt プライマリと各レプリカで準備したプリペアドステートメント
+type ClusterStmt struct {
+	cluster *Cluster
+	stmts   map[*DB]*Stmt
+}
+
+// PreparexContext 準備に失敗したレプリカは切り離し、そのレプリカに振り分けた参照はプライマリのステートメントで実行する
+func (c *Cluster) PreparexContext(ctx context.Context, query string) (*ClusterStmt, error) {
+	stmt, err := c.primary.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	cs := &ClusterStmt{cluster: c, stmts: map[*DB]*Stmt{c.primary: stmt}}
+	for _, r := range c.replicas {
+		stmt, err := r.db.PreparexContext(ctx, query)
+		if err != nil {
+			r.markDown(err)
+			continue
+		}
+		cs.stmts[r.db] = stmt
+	}
+	return cs, nil
+}
+
+func (cs *ClusterStmt) on(db *DB) *Stmt {
+	if stmt, ok := cs.stmts[db]; ok {
+		return stmt
+	}
+	return cs.stmts[cs.cluster.primary]
+}
+
+func (cs *ClusterStmt) GetContext(ctx context.Context, dest interface{}, args ...interface{}) error {
+	return cs.cluster.read(ctx, func(db *DB) error {
+		return cs.on(db).GetContext(ctx, dest, args...)
+	})
+}
+
+func (cs *ClusterStmt) SelectContext(ctx context.Context, dest interface{}, args ...interface{}) error {
+	return cs.cluster.read(ctx, func(db *DB) error {
+		return cs.on(db).SelectContext(ctx, dest, args...)
+	})
+}
+
+func (cs *ClusterStmt) Close() error {
+	for _, stmt := range cs.stmts {
+		stmt.Close()
+	}
+	return nil
+}
+
+type writtenClustersKey struct{}
+
+// writtenClusters リクエスト中に更新したクラスタ。以降の参照はプライマリから読む
+type writtenClusters struct {
+	mu       sync.Mutex
+	clusters map[*Cluster]bool
+}
+
+func withWriteTracking(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writtenClustersKey{}, &writtenClusters{clusters: map[*Cluster]bool{}})
+}
+
+// markWritten /initialize のようにSQLを経由せず更新した場合も呼び出し側で記録する
+func markWritten(ctx context.Context, clusters ...*Cluster) {
+	w, ok := ctx.Value(writtenClustersKey{}).(*writtenClusters)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, c := range clusters {
+		w.clusters[c] = true
+	}
+}
+
+func wroteInRequest(ctx context.Context, c *Cluster) bool {
+	w, ok := ctx.Value(writtenClustersKey{}).(*writtenClusters)
+	if !ok {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.clusters[c]
+}
+
+// ReadYourWritesMiddleware 同じリクエスト内で更新した内容を参照できるよう更新の有無を記録する
+func ReadYourWritesMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		c.SetRequest(req.WithContext(withWriteTracking(req.Context())))
+		return next(c)
+	}
+}
+
+func getReplicaStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string][]ReplicaStat{
+		"chair":  dbChair.ReplicaStats(),
+		"estate": dbEstate.ReplicaStats(),
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func testCluster(replicas int) *Cluster {
+	c := &Cluster{name: "test", primary: &DB{name: "primary"}}
+	for i := 0; i < replicas; i++ {
+		c.replicas = append(c.replicas, &replica{db: &DB{name: "replica"}, healthy: 1})
+	}
+	return c
+}
+
+func Test_ClusterReaderSkipsUnhealthyReplicas(t *testing.T) {
+	c := testCluster(3)
+	c.replicas[1].markDown(errors.New("down"))
+	seen := map[*DB]int{}
+	for i := 0; i < 30; i++ {
+		db, r := c.reader(context.Background())
+		if r == nil || r.db != db {
+			t.Fatalf("reader returned %v without its replica", db.name)
+		}
+		seen[db]++
+	}
+	if seen[c.replicas[1].db] != 0 || seen[c.replicas[0].db] == 0 || seen[c.replicas[2].db] == 0 {
+		t.Errorf("reads must go to the healthy replicas only: %v", seen)
+	}
+
+	for _, r := range c.replicas {
+		r.markDown(errors.New("down"))
+	}
+	if db, r := c.reader(context.Background()); db != c.primary || r != nil {
+		t.Errorf("reader must fall back to the primary when no replica is healthy")
+	}
+}
+
+func Test_ClusterReaderReadsYourWrites(t *testing.T) {
+	c, other := testCluster(2), testCluster(1)
+	ctx := withWriteTracking(context.Background())
+	markWritten(ctx, c)
+	if db, _ := c.reader(ctx); db != c.primary {
+		t.Errorf("reads after a write in the same request must go to the primary")
+	}
+	if db, _ := other.reader(ctx); db == other.primary {
+		t.Errorf("a write to another cluster must not pin reads to this primary")
+	}
+	if db, _ := c.reader(context.Background()); db == c.primary {
+		t.Errorf("other requests must keep reading from replicas")
+	}
+}
+
+func Test_ClusterReadFallsBackOnNodeFailure(t *testing.T) {
+	c := testCluster(1)
+	var tried []*DB
+	err := c.read(context.Background(), func(db *DB) error {
+		tried = append(tried, db)
+		if db != c.primary {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || len(tried) != 2 || tried[1] != c.primary {
+		t.Fatalf("read = %v after %d attempts", err, len(tried))
+	}
+	if c.replicas[0].healthy != 0 {
+		t.Errorf("the failed replica must be marked down")
+	}
+
+	// クエリの誤りはレプリカの障害ではないので、プライマリで再実行しない
+	c = testCluster(1)
+	tried = nil
+	queryErr := &mysql.MySQLError{Number: 1064, Message: "syntax error"}
+	err = c.read(context.Background(), func(db *DB) error {
+		tried = append(tried, db)
+		return queryErr
+	})
+	if err != queryErr || len(tried) != 1 || c.replicas[0].healthy != 1 {
+		t.Errorf("read = %v after %d attempts, healthy %d", err, len(tried), c.replicas[0].healthy)
+	}
+}
+
+func Test_ParseReplicaHosts(t *testing.T) {
+	primary := MySQLConnectionEnv{Host: "db", Port: "3306", User: "isucon", DBName: "isuumo", Password: "isucon"}
+	replicas, err := parseReplicaHosts("10.0.0.2:3307, 10.0.0.3 ,", primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != 2 || replicas[0].Host != "10.0.0.2" || replicas[0].Port != "3307" ||
+		replicas[1].Host != "10.0.0.3" || replicas[1].Port != "3306" || replicas[1].User != "isucon" {
+		t.Errorf("replicas = %+v", replicas)
+	}
+	if _, err := parseReplicaHosts("10.0.0.2:port", primary); err == nil {
+		t.Errorf("a non-numeric port must be rejected")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo"
+)
+
+// responseEncoders レスポンスの圧縮に使える Content-Encoding
+var responseEncoders = map[string]func(body []byte) ([]byte, error){
+	"br":   brotliBytes,
+	"gzip": gzipBytes,
+}
+
+// brotliLevel リクエストごとに圧縮するので、圧縮率より速さを優先した水準にする
+const brotliLevel = 4
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var brotliWriters = sync.Pool{
+	New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	},
+}
+
+var compressedResponses = map[string]*int64{}
+
+func init() {
+	for name := range responseEncoders {
+		compressedResponses[name] = new(int64)
+	}
+}
+
+func gzipBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func brotliBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotliWriters.Get().(*brotli.Writer)
+	defer brotliWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// validateEncodings 設定された Content-Encoding がすべてこのビルドで使えるか確認する
+func validateEncodings(encodings []string) error {
+	for _, name := range encodings {
+		if _, ok := responseEncoders[name]; !ok {
+			return fmt.Errorf("unsupported content encoding %q", name)
+		}
+	}
+	return nil
+}
+
+// negotiateEncoding Accept-Encoding の q 値が最も大きいものを、同じなら設定の順で先にあるものを選ぶ
+// どれも受け付けられなければ空文字を返し、圧縮せずに返す
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, name := range encodings {
+		q, ok := accepted[name]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// writeJSON エンコード済みのJSONを Content-Length を付けて返す
+// 設定の minBytes 以上でクライアントが受け付ける場合は圧縮し、圧縮後の長さを付ける
+func writeJSON(c echo.Context, code int, body []byte) error {
+	res := c.Response()
+	h := res.Header()
+	h.Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	if len(config.Compression.Encodings) > 0 {
+		h.Add("Vary", echo.HeaderAcceptEncoding)
+	}
+	if len(body) >= config.Compression.MinBytes {
+		if name := negotiateEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding), config.Compression.Encodings); name != "" {
+			compressed, err := responseEncoders[name](body)
+			if err != nil {
+				return err
+			}
+			if len(compressed) < len(body) {
+				atomic.AddInt64(compressedResponses[name], 1)
+				h.Set(echo.HeaderContentEncoding, name)
+				body = compressed
+			}
+		}
+	}
+	h.Set(echo.HeaderContentLength, strconv.Itoa(len(body)))
+	res.WriteHeader(code)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+	_, err := res.Write(body)
+	return err
+}
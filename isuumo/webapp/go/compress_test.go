@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo"
+)
+
+func Test_WriteJSONCompressesWithTheNegotiatedEncoding(t *testing.T) {
+	saved := config.Compression
+	config.Compression = CompressionConfig{Encodings: []string{"br", "gzip"}, MinBytes: 16}
+	defer func() { config.Compression = saved }()
+	body := []byte(`{"chairs":[` + strings.TrimSuffix(strings.Repeat(`{"id":1,"name":"椅子"},`, 50), ",") + `]}`)
+
+	decoders := map[string]func([]byte) ([]byte, error){
+		"br": func(b []byte) ([]byte, error) { return ioutil.ReadAll(brotli.NewReader(bytes.NewReader(b))) },
+		"gzip": func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		},
+	}
+	for accept, want := range map[string]string{
+		"gzip, deflate, br": "br",
+		"gzip":              "gzip",
+		"br;q=0.5, gzip":    "gzip",
+		"identity":          "",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/chair/low_priced", nil)
+		req.Header.Set(echo.HeaderAcceptEncoding, accept)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		v := newDataVersion()
+		if notModified(c, v, "chair-low-priced") {
+			t.Fatal("unconditional request")
+		}
+		if err := writeJSON(c, http.StatusOK, body); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get(echo.HeaderContentEncoding); got != want {
+			t.Errorf("%q: Content-Encoding = %q, want %q", accept, got, want)
+			continue
+		}
+		got := rec.Body.Bytes()
+		if want != "" {
+			var err error
+			if got, err = decoders[want](got); err != nil {
+				t.Fatalf("%q: %v", accept, err)
+			}
+			if etag := rec.Header().Get("ETag"); etag != codedETag(fmt.Sprintf(`"%s-0-chair-low-priced"`, bootID), want) {
+				t.Errorf("%q: ETag = %v", accept, etag)
+			}
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%q: body does not round-trip", accept)
+		}
+	}
+}
+
+func Test_BatchJSONMatchesEncodedResponse(t *testing.T) {
+	chairs := []Chair{{ID: 3, Name: "椅子", Price: 1000}, {ID: 1, Name: "ソファ", Price: 2000}}
+	for _, missing := range [][]int64{{}, {7}, {7, 9}} {
+		b, err := batchJSON("chairs", len(chairs), func(i int) ([]byte, error) {
+			return json.Marshal(chairs[i])
+		}, missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want interface{}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: %v", b, err)
+		}
+		encoded, _ := json.Marshal(map[string]interface{}{"chairs": chairs, "missingIds": missing})
+		json.Unmarshal(encoded, &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("batchJSON = %s, want %s", b, encoded)
+		}
+	}
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// defaultConfigFile CONFIG_FILE が未指定の場合に読むファイル。存在しなければ既定値のまま起動する
+const defaultConfigFile = "config.json"
+
+const redactedValue = "********"
+
+// Duration 設定ファイルでは "500ms" や "5m" のような文字列で書く
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type ServerConfig struct {
+	Port            string   `json:"port"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+}
+
+type MySQLConfig struct {
+	Estate               MySQLConnectionEnv   `json:"estate"`
+	Chair                MySQLConnectionEnv   `json:"chair"`
+	EstateReplicas       []MySQLConnectionEnv `json:"estateReplicas"`
+	ChairReplicas        []MySQLConnectionEnv `json:"chairReplicas"`
+	ChairShards          []ShardConfig        `json:"chairShards"`
+	MaxOpenConns         int                  `json:"maxOpenConns"`
+	MaxReplicaLag        Duration             `json:"maxReplicaLag"`
+	ReplicaCheckInterval Duration             `json:"replicaCheckInterval"`
+}
+
+type FixtureConfig struct {
+	ChairCondition  string `json:"chairCondition"`
+	EstateCondition string `json:"estateCondition"`
+}
+
+type SearchConfig struct {
+	Limit        int `json:"limit"`
+	NazotteLimit int `json:"nazotteLimit"`
+}
+
+type CacheConfig struct {
+	TTL             Duration `json:"ttl"`
+	CleanupInterval Duration `json:"cleanupInterval"`
+}
+
+type BotFilterConfig struct {
+	RulesFile string `json:"rulesFile"`
+}
+
+type TraceConfig struct {
+	File string `json:"file"`
+}
+
+type AccessLogConfig struct {
+	File       string  `json:"file"`
+	SampleRate float64 `json:"sampleRate"`
+}
+
+type LoadSheddingConfig struct {
+	InitialLimit  int      `json:"initialLimit"`
+	MinLimit      int      `json:"minLimit"`
+	MaxLimit      int      `json:"maxLimit"`
+	TargetLatency Duration `json:"targetLatency"`
+	RetryAfter    Duration `json:"retryAfter"`
+}
+
+// StockLedgerConfig journalFile が空ならメモリ上の在庫管理を使わない。既定では使わない
+type StockLedgerConfig struct {
+	JournalFile   string   `json:"journalFile"`
+	FlushInterval Duration `json:"flushInterval"`
+	BatchSize     int      `json:"batchSize"`
+}
+
+// CompressionConfig encodings が空ならレスポンスを圧縮しない。既定では圧縮しない
+type CompressionConfig struct {
+	Encodings []string `json:"encodings"`
+	MinBytes  int      `json:"minBytes"`
+}
+
+// ImportConfig dir が空なら非同期の投入を受け付けない。既定では受け付けない
+// 終わったジョブは jobTTL が過ぎたら状態を返さなくなる
+type ImportConfig struct {
+	Dir       string   `json:"dir"`
+	Workers   int      `json:"workers"`
+	QueueSize int      `json:"queueSize"`
+	BatchSize int      `json:"batchSize"`
+	JobTTL    Duration `json:"jobTTL"`
+}
+
+// AdminConfig keysFile が空なら管理用のルートを拒否する
+// allowUnauthenticated を true にしたときだけ、keysFile が空でも管理用のルートを認証せずに受け付ける。既定は false
+// ベンチマーカーは認証せずに /initialize や入稿を呼ぶため、配布する env.sh と docker-compose では true にしている
+type AdminConfig struct {
+	KeysFile             string   `json:"keysFile"`
+	AuditLogFile         string   `json:"auditLogFile"`
+	MaxClockSkew         Duration `json:"maxClockSkew"`
+	AllowUnauthenticated bool     `json:"allowUnauthenticated"`
+}
+
+// ChangeAuditConfig file が空なら椅子や物件の変更を記録しない。既定では記録しない
+// maxFileBytes を超えたファイルは回してすべて残す。maxFileBytes が0なら回さない
+// maxFiles を指定したときだけ、書き込み中のものを含めて maxFiles 個を超えた古いファイルを消す。既定では消さない
+type ChangeAuditConfig struct {
+	File         string `json:"file"`
+	MaxFileBytes int    `json:"maxFileBytes"`
+	MaxFiles     int    `json:"maxFiles"`
+}
+
+// SavedSearchConfig file が空なら検索条件の保存と通知を受け付けない。既定では受け付けない
+type SavedSearchConfig struct {
+	File           string   `json:"file"`
+	Workers        int      `json:"workers"`
+	QueueSize      int      `json:"queueSize"`
+	MaxAttempts    int      `json:"maxAttempts"`
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	Timeout        Duration `json:"timeout"`
+	// AllowedHosts 空でなければ列挙したホストにだけ通知する。列挙したホストは内部のアドレスでも許可する
+	AllowedHosts []string `json:"allowedHosts"`
+	// MaxSearches, MaxSearchesPerClient 保存できる検索条件の数の上限。クライアントはIPアドレスで区別する
+	MaxSearches          int `json:"maxSearches"`
+	MaxSearchesPerClient int `json:"maxSearchesPerClient"`
+	// CreatePerMinute クライアントごとに1分間に作成できる数。0なら制限しない
+	CreatePerMinute int `json:"createPerMinute"`
+}
+
+type EventsConfig struct {
+	BufferSize int      `json:"bufferSize"`
+	Heartbeat  Duration `json:"heartbeat"`
+}
+
+type TimeoutConfig struct {
+	Default Duration            `json:"default"`
+	Routes  map[string]Duration `json:"routes"`
+}
+
+// Config webapp の設定。既定値、設定ファイル、環境変数の順に上書きする
+type Config struct {
+	Server       ServerConfig       `json:"server"`
+	MySQL        MySQLConfig        `json:"mysql"`
+	Fixture      FixtureConfig      `json:"fixture"`
+	Search       SearchConfig       `json:"search"`
+	Cache        CacheConfig        `json:"cache"`
+	BotFilter    BotFilterConfig    `json:"botFilter"`
+	Trace        TraceConfig        `json:"trace"`
+	AccessLog    AccessLogConfig    `json:"accessLog"`
+	LoadShedding LoadSheddingConfig `json:"loadShedding"`
+	Timeout      TimeoutConfig      `json:"timeout"`
+	StockLedger  StockLedgerConfig  `json:"stockLedger"`
+	Compression  CompressionConfig  `json:"compression"`
+	Import       ImportConfig       `json:"import"`
+	Admin        AdminConfig        `json:"admin"`
+	ChangeAudit  ChangeAuditConfig  `json:"changeAudit"`
+	Events       EventsConfig       `json:"events"`
+	SavedSearch  SavedSearchConfig  `json:"savedSearch"`
+}
+
+// config テストやハンドラから参照できるよう起動前は既定値を持つ
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{Port: "1323", ShutdownTimeout: Duration(10 * time.Second)},
+		MySQL: MySQLConfig{
+			Estate:               MySQLConnectionEnv{Host: "172.31.36.65", Port: "3306", User: "isucon", DBName: "isuumo", Password: "isucon"},
+			Chair:                MySQLConnectionEnv{Host: "172.31.44.10", Port: "3306", User: "isucon", DBName: "isuumo", Password: "isucon"},
+			EstateReplicas:       []MySQLConnectionEnv{},
+			ChairReplicas:        []MySQLConnectionEnv{},
+			ChairShards:          []ShardConfig{},
+			MaxOpenConns:         10,
+			MaxReplicaLag:        Duration(time.Second),
+			ReplicaCheckInterval: Duration(time.Second),
+		},
+		Fixture: FixtureConfig{
+			ChairCondition:  "../fixture/chair_condition.json",
+			EstateCondition: "../fixture/estate_condition.json",
+		},
+		Search: SearchConfig{Limit: 20, NazotteLimit: 50},
+		Cache: CacheConfig{
+			TTL:             Duration(5 * time.Minute),
+			CleanupInterval: Duration(10 * time.Minute),
+		},
+		BotFilter: BotFilterConfig{RulesFile: "bot_rules.txt"},
+		AccessLog: AccessLogConfig{SampleRate: 1},
+		LoadShedding: LoadSheddingConfig{
+			InitialLimit:  20,
+			MinLimit:      2,
+			MaxLimit:      200,
+			TargetLatency: Duration(500 * time.Millisecond),
+			RetryAfter:    Duration(time.Second),
+		},
+		Timeout: TimeoutConfig{
+			Default: Duration(1800 * time.Millisecond),
+			Routes:  map[string]Duration{},
+		},
+		// 在庫台帳、圧縮、非同期の投入、変更の記録、検索条件の通知は既定では無効にし、設定したときだけ使う
+		StockLedger: StockLedgerConfig{
+			FlushInterval: Duration(100 * time.Millisecond),
+			BatchSize:     256,
+		},
+		Compression: CompressionConfig{
+			Encodings: []string{},
+			MinBytes:  1024,
+		},
+		Import: ImportConfig{
+			Workers:   2,
+			QueueSize: 64,
+			BatchSize: 500,
+			JobTTL:    Duration(24 * time.Hour),
+		},
+		Admin: AdminConfig{
+			AuditLogFile: "admin_audit.jsonl",
+			MaxClockSkew: Duration(5 * time.Minute),
+		},
+		ChangeAudit: ChangeAuditConfig{
+			MaxFileBytes: 64 << 20,
+		},
+		Events: EventsConfig{
+			BufferSize: 1024,
+			Heartbeat:  Duration(15 * time.Second),
+		},
+		SavedSearch: SavedSearchConfig{
+			Workers:        2,
+			QueueSize:      256,
+			MaxAttempts:    5,
+			InitialBackoff: Duration(time.Second),
+			MaxBackoff:     Duration(time.Minute),
+			Timeout:        Duration(5 * time.Second),
+
+			MaxSearches:          10000,
+			MaxSearchesPerClient: 20,
+			CreatePerMinute:      10,
+		},
+	}
+}
+
+// LoadConfig 設定ファイルと環境変数から設定を読み込んで検証する
+func LoadConfig() (*Config, error) {
+	c := defaultConfig()
+	path := getEnv("CONFIG_FILE", defaultConfigFile)
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	case os.IsNotExist(err) && path == defaultConfigFile:
+	default:
+		return nil, err
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func envString(dst *string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*dst = v
+	}
+}
+
+func envInt(dst *int, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%v: %v", key, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envBool(dst *bool, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%v: %v", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+func envFloat(dst *float64, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%v: %v", key, err)
+	}
+	*dst = f
+	return nil
+}
+
+// envMillis 既存の *_MS 環境変数との互換のためミリ秒の整数で受け取る
+func envMillis(dst *Duration, key string) error {
+	ms := -1
+	if err := envInt(&ms, key); err != nil {
+		return err
+	}
+	if ms >= 0 {
+		*dst = Duration(time.Duration(ms) * time.Millisecond)
+	}
+	return nil
+}
+
+// envReplicas "host:port,host:port" 形式で指定し、ユーザーやパスワードはプライマリと同じものを使う
+func envReplicas(dst *[]MySQLConnectionEnv, key string, primary MySQLConnectionEnv) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	replicas, err := parseReplicaHosts(v, primary)
+	if err != nil {
+		return fmt.Errorf("%v: %v", key, err)
+	}
+	*dst = replicas
+	return nil
+}
+
+// envShards "host:port,host:port" 形式でシャードのプライマリを指定する。レプリカは設定ファイルでのみ指定できる
+func envShards(dst *[]ShardConfig, key string, primary MySQLConnectionEnv) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	hosts, err := parseReplicaHosts(v, primary)
+	if err != nil {
+		return fmt.Errorf("%v: %v", key, err)
+	}
+	shards := make([]ShardConfig, 0, len(hosts))
+	for _, h := range hosts {
+		shards = append(shards, ShardConfig{Primary: h})
+	}
+	*dst = shards
+	return nil
+}
+
+// chairShardConfigs chairShards が空なら chair と chairReplicas の1シャードとして扱う
+func (c *MySQLConfig) chairShardConfigs() []ShardConfig {
+	if len(c.ChairShards) == 0 {
+		return []ShardConfig{{Primary: c.Chair, Replicas: c.ChairReplicas}}
+	}
+	return c.ChairShards
+}
+
+// applyEnv 環境変数で設定を上書きする。MYSQL_* は物件、椅子の両方のDBに適用する
+func (c *Config) applyEnv() error {
+	envString(&c.Server.Port, "SERVER_PORT")
+	for _, mc := range []*MySQLConnectionEnv{&c.MySQL.Estate, &c.MySQL.Chair} {
+		envString(&mc.Host, "MYSQL_HOST")
+		envString(&mc.Port, "MYSQL_PORT")
+		envString(&mc.User, "MYSQL_USER")
+		envString(&mc.DBName, "MYSQL_DBNAME")
+		envString(&mc.Password, "MYSQL_PASS")
+	}
+	envString(&c.Fixture.ChairCondition, "CHAIR_CONDITION_FILE")
+	envString(&c.Fixture.EstateCondition, "ESTATE_CONDITION_FILE")
+	envString(&c.BotFilter.RulesFile, "BOT_RULES_FILE")
+	envString(&c.Trace.File, "TRACE_FILE")
+	envString(&c.AccessLog.File, "ACCESS_LOG_FILE")
+	envString(&c.Admin.KeysFile, "ADMIN_KEYS_FILE")
+	envString(&c.Admin.AuditLogFile, "ADMIN_AUDIT_LOG_FILE")
+	if v, ok := os.LookupEnv("STOCK_JOURNAL_FILE"); ok {
+		// 空文字を指定すると、設定ファイルで有効にしたメモリ上の在庫管理を無効にできる
+		c.StockLedger.JournalFile = v
+	}
+	if v, ok := os.LookupEnv("CHANGE_AUDIT_FILE"); ok {
+		// 空文字を指定すると、設定ファイルで有効にした変更の記録を無効にできる
+		c.ChangeAudit.File = v
+	}
+	if v, ok := os.LookupEnv("SAVED_SEARCH_FILE"); ok {
+		// 空文字を指定すると、設定ファイルで有効にした検索条件の保存と通知を無効にできる
+		c.SavedSearch.File = v
+	}
+	if v, ok := os.LookupEnv("WEBHOOK_ALLOWED_HOSTS"); ok {
+		c.SavedSearch.AllowedHosts = []string{}
+		for _, host := range strings.Split(v, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.SavedSearch.AllowedHosts = append(c.SavedSearch.AllowedHosts, host)
+			}
+		}
+	}
+	if v, ok := os.LookupEnv("IMPORT_DIR"); ok {
+		// 空文字を指定すると、設定ファイルで有効にした非同期の投入を無効にできる
+		c.Import.Dir = v
+	}
+	if v, ok := os.LookupEnv("RESPONSE_ENCODINGS"); ok {
+		// "br,gzip" のように指定すると圧縮する。空文字なら設定ファイルで有効にした圧縮を無効にする
+		c.Compression.Encodings = []string{}
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.Compression.Encodings = append(c.Compression.Encodings, name)
+			}
+		}
+	}
+
+	for _, f := range []func() error{
+		func() error { return envInt(&c.MySQL.MaxOpenConns, "MYSQL_MAX_OPEN_CONNS") },
+		func() error { return envMillis(&c.MySQL.MaxReplicaLag, "MYSQL_MAX_REPLICA_LAG_MS") },
+		func() error { return envReplicas(&c.MySQL.EstateReplicas, "MYSQL_ESTATE_REPLICAS", c.MySQL.Estate) },
+		func() error { return envReplicas(&c.MySQL.ChairReplicas, "MYSQL_CHAIR_REPLICAS", c.MySQL.Chair) },
+		func() error { return envShards(&c.MySQL.ChairShards, "MYSQL_CHAIR_SHARDS", c.MySQL.Chair) },
+		func() error { return envInt(&c.Search.Limit, "SEARCH_LIMIT") },
+		func() error { return envInt(&c.Search.NazotteLimit, "NAZOTTE_LIMIT") },
+		func() error { return envFloat(&c.AccessLog.SampleRate, "ACCESS_LOG_SAMPLE_RATE") },
+		func() error { return envInt(&c.LoadShedding.InitialLimit, "LIMITER_INITIAL_LIMIT") },
+		func() error { return envInt(&c.LoadShedding.MinLimit, "LIMITER_MIN_LIMIT") },
+		func() error { return envInt(&c.LoadShedding.MaxLimit, "LIMITER_MAX_LIMIT") },
+		func() error { return envMillis(&c.LoadShedding.TargetLatency, "LIMITER_TARGET_LATENCY_MS") },
+		func() error { return envMillis(&c.Timeout.Default, "REQUEST_TIMEOUT_MS") },
+		func() error { return envMillis(&c.Server.ShutdownTimeout, "SHUTDOWN_TIMEOUT_MS") },
+		func() error { return envMillis(&c.StockLedger.FlushInterval, "STOCK_FLUSH_INTERVAL_MS") },
+		func() error { return envInt(&c.StockLedger.BatchSize, "STOCK_FLUSH_BATCH_SIZE") },
+		func() error { return envInt(&c.Compression.MinBytes, "RESPONSE_COMPRESS_MIN_BYTES") },
+		func() error { return envInt(&c.Import.Workers, "IMPORT_WORKERS") },
+		func() error { return envMillis(&c.Admin.MaxClockSkew, "ADMIN_MAX_CLOCK_SKEW_MS") },
+		func() error { return envBool(&c.Admin.AllowUnauthenticated, "ADMIN_ALLOW_UNAUTHENTICATED") },
+		func() error { return envInt(&c.ChangeAudit.MaxFileBytes, "CHANGE_AUDIT_MAX_FILE_BYTES") },
+		func() error { return envInt(&c.ChangeAudit.MaxFiles, "CHANGE_AUDIT_MAX_FILES") },
+		func() error { return envInt(&c.Events.BufferSize, "EVENTS_BUFFER_SIZE") },
+		func() error { return envMillis(&c.Events.Heartbeat, "EVENTS_HEARTBEAT_MS") },
+		func() error { return envInt(&c.Import.QueueSize, "IMPORT_QUEUE_SIZE") },
+		func() error { return envInt(&c.Import.BatchSize, "IMPORT_BATCH_SIZE") },
+		func() error { return envMillis(&c.Import.JobTTL, "IMPORT_JOB_TTL_MS") },
+		func() error { return envInt(&c.SavedSearch.Workers, "WEBHOOK_WORKERS") },
+		func() error { return envInt(&c.SavedSearch.MaxAttempts, "WEBHOOK_MAX_ATTEMPTS") },
+		func() error { return envMillis(&c.SavedSearch.InitialBackoff, "WEBHOOK_INITIAL_BACKOFF_MS") },
+		func() error { return envMillis(&c.SavedSearch.MaxBackoff, "WEBHOOK_MAX_BACKOFF_MS") },
+		func() error { return envMillis(&c.SavedSearch.Timeout, "WEBHOOK_TIMEOUT_MS") },
+		func() error { return envInt(&c.SavedSearch.MaxSearches, "SAVED_SEARCH_MAX") },
+		func() error { return envInt(&c.SavedSearch.MaxSearchesPerClient, "SAVED_SEARCH_MAX_PER_CLIENT") },
+		func() error { return envInt(&c.SavedSearch.CreatePerMinute, "SAVED_SEARCH_CREATE_PER_MINUTE") },
+	} {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+
+	if v := os.Getenv("ROUTE_TIMEOUTS"); v != "" {
+		overrides, err := parseRouteTimeoutOverrides(v)
+		if err != nil {
+			return fmt.Errorf("ROUTE_TIMEOUTS: %v", err)
+		}
+		if c.Timeout.Routes == nil {
+			c.Timeout.Routes = map[string]Duration{}
+		}
+		for k, d := range overrides {
+			c.Timeout.Routes[k] = Duration(d)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Server.Port == "" {
+		return fmt.Errorf("server.port is empty")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		return fmt.Errorf("server.shutdownTimeout must be positive")
+	}
+	conns := map[string]MySQLConnectionEnv{"estate": c.MySQL.Estate, "chair": c.MySQL.Chair}
+	for i, mc := range c.MySQL.EstateReplicas {
+		conns[fmt.Sprintf("estateReplicas[%d]", i)] = mc
+	}
+	for i, mc := range c.MySQL.ChairReplicas {
+		conns[fmt.Sprintf("chairReplicas[%d]", i)] = mc
+	}
+	for i, s := range c.MySQL.ChairShards {
+		conns[fmt.Sprintf("chairShards[%d].primary", i)] = s.Primary
+		for j, mc := range s.Replicas {
+			conns[fmt.Sprintf("chairShards[%d].replicas[%d]", i, j)] = mc
+		}
+	}
+	for name, mc := range conns {
+		if mc.Host == "" || mc.Port == "" || mc.User == "" || mc.DBName == "" {
+			return fmt.Errorf("mysql.%v: host, port, user and dbName are required", name)
+		}
+	}
+	if c.MySQL.MaxOpenConns <= 0 {
+		return fmt.Errorf("mysql.maxOpenConns must be positive")
+	}
+	if c.MySQL.MaxReplicaLag < 0 || c.MySQL.ReplicaCheckInterval <= 0 {
+		return fmt.Errorf("mysql replica durations are invalid")
+	}
+	if c.Fixture.ChairCondition == "" || c.Fixture.EstateCondition == "" {
+		return fmt.Errorf("fixture paths are empty")
+	}
+	if c.Search.Limit <= 0 || c.Search.NazotteLimit <= 0 {
+		return fmt.Errorf("search limits must be positive")
+	}
+	if c.Cache.TTL <= 0 || c.Cache.CleanupInterval <= 0 {
+		return fmt.Errorf("cache durations must be positive")
+	}
+	if c.AccessLog.SampleRate < 0 || c.AccessLog.SampleRate > 1 {
+		return fmt.Errorf("accessLog.sampleRate must be between 0 and 1")
+	}
+	ls := c.LoadShedding
+	if ls.MinLimit <= 0 || ls.MinLimit > ls.InitialLimit || ls.InitialLimit > ls.MaxLimit {
+		return fmt.Errorf("loadShedding limits must satisfy 0 < minLimit <= initialLimit <= maxLimit")
+	}
+	if ls.TargetLatency <= 0 || ls.RetryAfter < 0 {
+		return fmt.Errorf("loadShedding durations are invalid")
+	}
+	if c.Timeout.Default < 0 {
+		return fmt.Errorf("timeout.default must not be negative")
+	}
+	if c.StockLedger.JournalFile != "" && (c.StockLedger.FlushInterval <= 0 || c.StockLedger.BatchSize <= 0) {
+		return fmt.Errorf("stockLedger.flushInterval and batchSize must be positive")
+	}
+	if c.Import.Dir != "" && (c.Import.Workers <= 0 || c.Import.QueueSize <= 0 || c.Import.BatchSize <= 0 || c.Import.JobTTL <= 0) {
+		return fmt.Errorf("import.workers, queueSize, batchSize and jobTTL must be positive")
+	}
+	if ca := c.ChangeAudit; ca.File != "" && (ca.MaxFileBytes < 0 || ca.MaxFiles < 0 || ca.MaxFiles == 1) {
+		return fmt.Errorf("changeAudit.maxFileBytes and maxFiles must not be negative and maxFiles must be 0 to keep every file or at least 2")
+	}
+	if c.Events.BufferSize <= 0 || c.Events.Heartbeat <= 0 {
+		return fmt.Errorf("events.bufferSize and heartbeat must be positive")
+	}
+	if ss := c.SavedSearch; ss.File != "" {
+		if ss.Workers <= 0 || ss.QueueSize <= 0 || ss.MaxAttempts <= 0 {
+			return fmt.Errorf("savedSearch.workers, queueSize and maxAttempts must be positive")
+		}
+		if ss.InitialBackoff <= 0 || ss.MaxBackoff < ss.InitialBackoff || ss.Timeout <= 0 {
+			return fmt.Errorf("savedSearch durations must satisfy 0 < initialBackoff <= maxBackoff and 0 < timeout")
+		}
+		if ss.MaxSearches <= 0 || ss.MaxSearchesPerClient <= 0 || ss.CreatePerMinute < 0 {
+			return fmt.Errorf("savedSearch.maxSearches and maxSearchesPerClient must be positive and createPerMinute must not be negative")
+		}
+	}
+	if c.Admin.KeysFile != "" && c.Admin.MaxClockSkew <= 0 {
+		return fmt.Errorf("admin.maxClockSkew must be positive")
+	}
+	if err := validateEncodings(c.Compression.Encodings); err != nil {
+		return fmt.Errorf("compression.encodings: %v", err)
+	}
+	if c.Compression.MinBytes < 0 {
+		return fmt.Errorf("compression.minBytes must not be negative")
+	}
+	for route, d := range c.Timeout.Routes {
+		if d < 0 {
+			return fmt.Errorf("timeout.routes[%v] must not be negative", route)
+		}
+	}
+	return nil
+}
+
+// redacted パスワードなどの秘密の値を伏せた設定のコピーを返す
+func (c *Config) redacted() Config {
+	r := *c
+	redact := func(mc MySQLConnectionEnv) MySQLConnectionEnv {
+		if mc.Password != "" {
+			mc.Password = redactedValue
+		}
+		return mc
+	}
+	r.MySQL.Estate = redact(r.MySQL.Estate)
+	r.MySQL.Chair = redact(r.MySQL.Chair)
+	r.MySQL.EstateReplicas = make([]MySQLConnectionEnv, 0, len(c.MySQL.EstateReplicas))
+	for _, mc := range c.MySQL.EstateReplicas {
+		r.MySQL.EstateReplicas = append(r.MySQL.EstateReplicas, redact(mc))
+	}
+	r.MySQL.ChairReplicas = make([]MySQLConnectionEnv, 0, len(c.MySQL.ChairReplicas))
+	for _, mc := range c.MySQL.ChairReplicas {
+		r.MySQL.ChairReplicas = append(r.MySQL.ChairReplicas, redact(mc))
+	}
+	r.MySQL.ChairShards = make([]ShardConfig, 0, len(c.MySQL.ChairShards))
+	for _, s := range c.MySQL.ChairShards {
+		shard := ShardConfig{Primary: redact(s.Primary), Replicas: make([]MySQLConnectionEnv, 0, len(s.Replicas))}
+		for _, mc := range s.Replicas {
+			shard.Replicas = append(shard.Replicas, redact(mc))
+		}
+		r.MySQL.ChairShards = append(r.MySQL.ChairShards, shard)
+	}
+	return r
+}
+
+func (c *Config) limiterConfig() LimiterConfig {
+	return LimiterConfig{
+		InitialLimit:  float64(c.LoadShedding.InitialLimit),
+		MinLimit:      float64(c.LoadShedding.MinLimit),
+		MaxLimit:      float64(c.LoadShedding.MaxLimit),
+		TargetLatency: time.Duration(c.LoadShedding.TargetLatency),
+		RetryAfter:    time.Duration(c.LoadShedding.RetryAfter),
+	}
+}
+
+func getConfig(c echo.Context) error {
+	return c.JSON(http.StatusOK, config.redacted())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DB sqlx.DB のクエリごとにレイテンシ、行数、エラーを queryStats に記録し、トレースのスパンを作る
+// クライアントが切断したリクエストのクエリをすぐに止められるよう、クエリを発行するメソッドは context を必ず受け取る
+type DB struct {
+	conn *sqlx.DB
+	name string
+}
+
+type Tx struct {
+	tx   *sqlx.Tx
+	name string
+}
+
+type Stmt struct {
+	stmt  *sqlx.Stmt
+	query string
+	name  string
+}
+
+// resultRows Select の結果のスライスの長さを返す
+func resultRows(dest interface{}) int64 {
+	v := reflect.ValueOf(dest)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Slice {
+		return int64(v.Len())
+	}
+	return 1
+}
+
+func affectedRows(res sql.Result, err error) int64 {
+	if err != nil {
+		return 0
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func getRows(err error) int64 {
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+// observeQuery クエリの実行を queryStats とトレースに記録する
+func observeQuery(ctx context.Context, dbName, op, query string, f func(ctx context.Context) (int64, error)) error {
+	ctx, span := startSpan(ctx, "db."+op, SpanKindClient)
+	span.SetAttribute("db.system", "mysql")
+	span.SetAttribute("db.name", dbName)
+	span.SetAttribute("db.statement", fingerprint(query))
+	start := time.Now()
+	rows, err := f(ctx)
+	queryStats.record(query, time.Since(start), rows, err)
+	if err != nil {
+		if reason := cancelReason(ctx); reason != "" {
+			metrics.addQueryCancellation(dbName, reason)
+			span.SetAttribute("db.cancel_reason", reason)
+		}
+	}
+	span.SetAttribute("db.rows", rows)
+	if err != sql.ErrNoRows {
+		span.SetError(err)
+	}
+	span.Finish()
+	return err
+}
+
+func (db *DB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return observeQuery(ctx, db.name, "get", query, func(ctx context.Context) (int64, error) {
+		err := db.conn.GetContext(ctx, dest, query, args...)
+		return getRows(err), err
+	})
+}
+
+func (db *DB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return observeQuery(ctx, db.name, "select", query, func(ctx context.Context) (int64, error) {
+		err := db.conn.SelectContext(ctx, dest, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return resultRows(dest), nil
+	})
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := observeQuery(ctx, db.name, "exec", query, func(ctx context.Context) (int64, error) {
+		var err error
+		res, err = db.conn.ExecContext(ctx, query, args...)
+		return affectedRows(res, err), err
+	})
+	return res, err
+}
+
+func (db *DB) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := observeQuery(ctx, db.name, "exec", query, func(ctx context.Context) (int64, error) {
+		var err error
+		res, err = db.conn.NamedExecContext(ctx, query, arg)
+		return affectedRows(res, err), err
+	})
+	return res, err
+}
+
+func (db *DB) BeginTxx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.conn.BeginTxx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, name: db.name}, nil
+}
+
+func (db *DB) PreparexContext(ctx context.Context, query string) (*Stmt, error) {
+	stmt, err := db.conn.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{stmt: stmt, query: query, name: db.name}, nil
+}
+
+func (db *DB) PingContext(ctx context.Context) error {
+	return db.conn.PingContext(ctx)
+}
+
+func (db *DB) SetMaxOpenConns(n int) {
+	db.conn.SetMaxOpenConns(n)
+}
+
+func (db *DB) Stats() sql.DBStats {
+	return db.conn.Stats()
+}
+
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
+
+// QueryRowxContext 行の読み出しとエラーの判定は Scan まで遅延されるため、クエリの実行時間のみを記録する
+func (tx *Tx) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	var row *sqlx.Row
+	observeQuery(ctx, tx.name, "get", query, func(ctx context.Context) (int64, error) {
+		row = tx.tx.QueryRowxContext(ctx, query, args...)
+		return 1, row.Err()
+	})
+	return row
+}
+
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := observeQuery(ctx, tx.name, "exec", query, func(ctx context.Context) (int64, error) {
+		var err error
+		res, err = tx.tx.ExecContext(ctx, query, args...)
+		return affectedRows(res, err), err
+	})
+	return res, err
+}
+
+func (s *Stmt) GetContext(ctx context.Context, dest interface{}, args ...interface{}) error {
+	return observeQuery(ctx, s.name, "get", s.query, func(ctx context.Context) (int64, error) {
+		err := s.stmt.GetContext(ctx, dest, args...)
+		return getRows(err), err
+	})
+}
+
+func (s *Stmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *Stmt) SelectContext(ctx context.Context, dest interface{}, args ...interface{}) error {
+	return observeQuery(ctx, s.name, "select", s.query, func(ctx context.Context) (int64, error) {
+		err := s.stmt.SelectContext(ctx, dest, args...)
+		if err != nil {
+			return 0, err
+		}
+		return resultRows(dest), nil
+	})
+}
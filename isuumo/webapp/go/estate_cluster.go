@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// ClusterGridPerTile ズームレベルごとのタイル1枚を一辺あたり何セルに分割して集計するか
+const ClusterGridPerTile = 8
+const MaxClusterZoom = 22
+
+type EstateCluster struct {
+	Latitude  float64 `db:"latitude" json:"latitude"`
+	Longitude float64 `db:"longitude" json:"longitude"`
+	Count     int64   `db:"count" json:"count"`
+	MinRent   int64   `db:"min_rent" json:"minRent"`
+	CellX     int64   `db:"cell_x" json:"-"`
+	CellY     int64   `db:"cell_y" json:"-"`
+}
+
+type EstateClusterResponse struct {
+	Zoom     int             `json:"zoom"`
+	CellSize float64         `json:"cellSize"`
+	Clusters []EstateCluster `json:"clusters"`
+}
+
+// parseBoundingBox "西端経度,南端緯度,東端経度,北端緯度" 形式のbboxをパースする
+func parseBoundingBox(s string) (BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, fmt.Errorf("bbox must have 4 values")
+	}
+	values := make([]float64, 0, 4)
+	for _, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return BoundingBox{}, err
+		}
+		values = append(values, v)
+	}
+	west, south, east, north := values[0], values[1], values[2], values[3]
+	if west > east || south > north {
+		return BoundingBox{}, fmt.Errorf("bbox corners are reversed")
+	}
+	if south < -90 || north > 90 || west < -180 || east > 180 {
+		return BoundingBox{}, fmt.Errorf("bbox is out of range")
+	}
+	return BoundingBox{
+		TopLeftCorner:     Coordinate{Latitude: south, Longitude: west},
+		BottomRightCorner: Coordinate{Latitude: north, Longitude: east},
+	}, nil
+}
+
+// toPolygonText estate.point (POINT(latitude, longitude)) と比較できるPOLYGONのWKTを返す
+func (b BoundingBox) toPolygonText() string {
+	min, max := b.TopLeftCorner, b.BottomRightCorner
+	return fmt.Sprintf("POLYGON((%f %f,%f %f,%f %f,%f %f,%f %f))",
+		min.Latitude, min.Longitude,
+		max.Latitude, min.Longitude,
+		max.Latitude, max.Longitude,
+		min.Latitude, max.Longitude,
+		min.Latitude, min.Longitude,
+	)
+}
+
+// clusterCellSize ズームレベルに対応するグリッドの一辺の大きさ(度)を返す
+func clusterCellSize(zoom int) float64 {
+	return 360 / math.Exp2(float64(zoom)) / ClusterGridPerTile
+}
+
+func getEstateClusters(c echo.Context) error {
+	bbox, err := parseBoundingBox(c.QueryParam("bbox"))
+	if err != nil {
+		c.Echo().Logger.Infof("bbox invalid, %v : %v", c.QueryParam("bbox"), err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	zoom, err := strconv.Atoi(c.QueryParam("zoom"))
+	if err != nil || zoom < 0 || zoom > MaxClusterZoom {
+		c.Echo().Logger.Infof("zoom invalid : %v", c.QueryParam("zoom"))
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	conditions, params, err := estateSearchConditions(c)
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	conditions = append([]string{"MBRContains(ST_PolygonFromText(?), point)", "status = ?"}, conditions...)
+	params = append([]interface{}{bbox.toPolygonText(), EstateStatusAvailable}, params...)
+
+	cellSize := clusterCellSize(zoom)
+	query := `SELECT FLOOR(latitude / ?) AS cell_y, FLOOR(longitude / ?) AS cell_x, COUNT(*) AS count, AVG(latitude) AS latitude, AVG(longitude) AS longitude, MIN(rent) AS min_rent FROM estate WHERE ` +
+		strings.Join(conditions, " AND ") +
+		` GROUP BY cell_y, cell_x ORDER BY cell_y, cell_x`
+	params = append([]interface{}{cellSize, cellSize}, params...)
+
+	clusters := []EstateCluster{}
+	err = dbEstate.SelectContext(c.Request().Context(), &clusters, query, params...)
+	if err != nil {
+		c.Logger().Errorf("getEstateClusters DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, EstateClusterResponse{
+		Zoom:     zoom,
+		CellSize: cellSize,
+		Clusters: clusters,
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const regionConditionCacheKey = "regionCondition"
+
+// regionUpdateChunkSize 住所の補完で1回のUPDATEに含める物件数
+const regionUpdateChunkSize = 1000
+
+type CityCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type RegionCount struct {
+	Prefecture string      `json:"prefecture"`
+	Count      int64       `json:"count"`
+	Cities     []CityCount `json:"cities"`
+}
+
+type RegionCondition struct {
+	List []RegionCount `json:"list"`
+}
+
+type regionRow struct {
+	Prefecture string `db:"prefecture"`
+	City       string `db:"city"`
+	Count      int64  `db:"count"`
+}
+
+// getRegionCondition 募集中の物件数を都道府県、市区町村ごとに集計する
+func getRegionCondition(ctx context.Context) (RegionCondition, error) {
+	if v, found := estateCacheManager.GetContext(ctx, regionConditionCacheKey); found {
+		return v.(RegionCondition), nil
+	}
+
+	rows := []regionRow{}
+	err := dbEstate.SelectContext(ctx, &rows, "SELECT prefecture, city, COUNT(*) AS count FROM estate WHERE status = ? AND prefecture != '' GROUP BY prefecture, city", EstateStatusAvailable)
+	if err != nil {
+		return RegionCondition{}, err
+	}
+
+	regions := map[string]*RegionCount{}
+	for _, r := range rows {
+		region, ok := regions[r.Prefecture]
+		if !ok {
+			region = &RegionCount{Prefecture: r.Prefecture, Cities: []CityCount{}}
+			regions[r.Prefecture] = region
+		}
+		region.Count += r.Count
+		if r.City != "" {
+			region.Cities = append(region.Cities, CityCount{Name: r.City, Count: r.Count})
+		}
+	}
+
+	cond := RegionCondition{List: make([]RegionCount, 0, len(regions))}
+	for _, region := range regions {
+		sort.Slice(region.Cities, func(i, j int) bool {
+			return region.Cities[i].Name < region.Cities[j].Name
+		})
+		cond.List = append(cond.List, *region)
+	}
+	sort.Slice(cond.List, func(i, j int) bool {
+		return prefectureOrder[cond.List[i].Prefecture] < prefectureOrder[cond.List[j].Prefecture]
+	})
+
+	estateCacheManager.Set(regionConditionCacheKey, cond, gocache.DefaultExpiration)
+	return cond, nil
+}
+
+// fillEstateRegions 都道府県が未設定の物件について住所から都道府県と市区町村を補完する
+// 初期データのSQLは住所しか持たないため、データ投入後に呼び出す
+func fillEstateRegions(ctx context.Context, db *Cluster) error {
+	type estateAddress struct {
+		ID      int64  `db:"id"`
+		Address string `db:"address"`
+	}
+	addresses := []estateAddress{}
+	err := db.SelectContext(ctx, &addresses, "SELECT id, address FROM estate WHERE prefecture = ''")
+	if err != nil {
+		return err
+	}
+
+	type region struct {
+		prefecture string
+		city       string
+	}
+	ids := map[region][]int64{}
+	for _, a := range addresses {
+		prefecture, city := parseAddress(a.Address)
+		if prefecture == "" {
+			continue
+		}
+		r := region{prefecture: prefecture, city: city}
+		ids[r] = append(ids[r], a.ID)
+	}
+
+	filled := 0
+	for r, regionIDs := range ids {
+		for len(regionIDs) > 0 {
+			n := len(regionIDs)
+			if n > regionUpdateChunkSize {
+				n = regionUpdateChunkSize
+			}
+			query, params, err := sqlx.In("UPDATE estate SET prefecture = ?, city = ? WHERE id IN (?)", r.prefecture, r.city, regionIDs[:n])
+			if err != nil {
+				return err
+			}
+			if _, err := db.ExecContext(ctx, query, params...); err != nil {
+				return err
+			}
+			filled += n
+			regionIDs = regionIDs[n:]
+		}
+	}
+	estateCacheManager.Flush()
+	if filled > 0 {
+		// 住所から導出する列のため、物件ごとではなく補完した件数だけを記録する
+		recordChanges(ChangeAuditEntry{
+			Actor:  changeActorSystem,
+			Action: ChangeUpdate,
+			Kind:   listingKindEstate,
+			After:  map[string]interface{}{"fields": []string{"prefecture", "city"}, "estates": filled, "regions": len(ids)},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 物件の募集状況
+const (
+	EstateStatusAvailable  = "available"
+	EstateStatusApplied    = "applied"
+	EstateStatusContracted = "contracted"
+	EstateStatusWithdrawn  = "withdrawn"
+)
+
+// estateStatusTransitions 遷移元の状態ごとに遷移可能な状態を持っている
+var estateStatusTransitions = map[string][]string{
+	EstateStatusAvailable:  {EstateStatusApplied, EstateStatusContracted, EstateStatusWithdrawn},
+	EstateStatusApplied:    {EstateStatusAvailable, EstateStatusContracted, EstateStatusWithdrawn},
+	EstateStatusContracted: {EstateStatusAvailable},
+	EstateStatusWithdrawn:  {EstateStatusAvailable},
+}
+
+type EstateStatusRequest struct {
+	Status string `json:"status"`
+}
+
+func canTransitEstateStatus(from, to string) bool {
+	for _, s := range estateStatusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func postEstateStatus(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("post estate status failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	req := EstateStatusRequest{}
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("post estate status failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if _, ok := estateStatusTransitions[req.Status]; !ok {
+		c.Echo().Logger.Infof("post estate status failed : unknown status %v", req.Status)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	tx, err := dbEstate.BeginTxx(c.Request().Context(), nil)
+	if err != nil {
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var estate Estate
+	err = tx.QueryRowxContext(c.Request().Context(), "SELECT * FROM estate WHERE id = ? FOR UPDATE", id).StructScan(&estate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("postEstateStatus estate id \"%v\" not found", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Echo().Logger.Errorf("DB Execution Error: on getting an estate by id : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if !canTransitEstateStatus(estate.Status, req.Status) {
+		c.Echo().Logger.Infof("postEstateStatus estate id \"%v\" cannot transit from %v to %v", id, estate.Status, req.Status)
+		return c.NoContent(http.StatusConflict)
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(c.Request().Context(), "UPDATE estate SET status = ?, status_changed_at = ? WHERE id = ?", req.Status, now, id)
+	if err != nil {
+		c.Echo().Logger.Errorf("estate status update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	estateCacheManager.Flush()
+	estateDataVersion.bump()
+
+	recordChanges(ChangeAuditEntry{
+		RequestID: requestID(c),
+		Actor:     changeActor(c),
+		Action:    ChangeStatusChange,
+		Kind:      listingKindEstate,
+		ListingID: estate.ID,
+		Before:    map[string]interface{}{"status": estate.Status, "statusChangedAt": estate.StatusChangedAt},
+		After:     map[string]interface{}{"status": req.Status, "statusChangedAt": now},
+	})
+	estate.Status = req.Status
+	estate.StatusChangedAt = &now
+	return fragmentResponse(c, estate.fragment)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// TileFeatureLimit タイル1枚に含める物件数の上限
+const TileFeatureLimit = 1000
+const MaxTileZoom = 22
+const TileCacheMaxAge = 60
+
+// tileBoundingBox slippy map のタイル座標が覆う範囲を返す
+func tileBoundingBox(z, x, y int) BoundingBox {
+	n := math.Exp2(float64(z))
+	lon := func(x int) float64 {
+		return float64(x)/n*360 - 180
+	}
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+	return BoundingBox{
+		TopLeftCorner:     Coordinate{Latitude: lat(y + 1), Longitude: lon(x)},
+		BottomRightCorner: Coordinate{Latitude: lat(y), Longitude: lon(x + 1)},
+	}
+}
+
+func parseTileCoordinate(c echo.Context) (int, int, int, error) {
+	z, err := strconv.Atoi(c.Param("z"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if z < 0 || z > MaxTileZoom {
+		return 0, 0, 0, fmt.Errorf("zoom is out of range")
+	}
+	x, err := strconv.Atoi(c.Param("x"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	y, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(c.Param("y"), ".geojson"), ".json"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	n := 1 << uint(z)
+	if x < 0 || x >= n || y < 0 || y >= n {
+		return 0, 0, 0, fmt.Errorf("tile is out of range")
+	}
+	return z, x, y, nil
+}
+
+func getEstateTile(c echo.Context) error {
+	z, x, y, err := parseTileCoordinate(c)
+	if err != nil {
+		c.Echo().Logger.Infof("tile coordinate invalid, %v/%v/%v : %v", c.Param("z"), c.Param("x"), c.Param("y"), err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	conditions, params, err := estateSearchConditions(c)
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	bbox := tileBoundingBox(z, x, y)
+	conditions = append([]string{"MBRContains(ST_PolygonFromText(?), point)", "status = ?"}, conditions...)
+	params = append([]interface{}{bbox.toPolygonText(), EstateStatusAvailable}, params...)
+
+	query := "SELECT * FROM estate WHERE " + strings.Join(conditions, " AND ") + " ORDER BY popularity_reversed, id ASC LIMIT ?"
+	params = append(params, TileFeatureLimit)
+
+	estates := []Estate{}
+	err = dbEstate.SelectContext(c.Request().Context(), &estates, query, params...)
+	if err != nil {
+		c.Logger().Errorf("getEstateTile DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	features := make([]GeoJSONFeature, 0, len(estates))
+	for _, estate := range estates {
+		features = append(features, estate.toGeoJSONFeature(map[string]interface{}{
+			"id":         estate.ID,
+			"name":       estate.Name,
+			"rent":       estate.Rent,
+			"popularity": estate.Popularity,
+		}))
+	}
+	body, err := json.Marshal(newGeoJSONFeatureCollection(features))
+	if err != nil {
+		c.Logger().Errorf("getEstateTile failed to encode tile : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", TileCacheMaxAge))
+	return blobWithETag(c, GeoJSONMIMEType, body)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// strongETag レスポンスボディのハッシュから強いETagを作る
+func strongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// codedETag 圧縮したボディは圧縮前と別の表現なので、強いETagに Content-Encoding を付けて区別する
+func codedETag(etag, coding string) string {
+	if len(etag) < 2 || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// matchingETag If-None-Match ヘッダに指定されたETagのうち、etag か、それを圧縮した表現のETagと一致したものを返す
+func matchingETag(ifNoneMatch, etag string) string {
+	if ifNoneMatch == "" {
+		return ""
+	}
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag {
+			return etag
+		}
+		for coding := range responseEncoders {
+			if t == codedETag(etag, coding) {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// etagMatches If-None-Match ヘッダに指定されたETagのいずれかと一致するか
+func etagMatches(ifNoneMatch, etag string) bool {
+	return matchingETag(ifNoneMatch, etag) != ""
+}
+
+// blobWithETag ETagを付けてレスポンスを返す。If-None-Match が一致した場合は 304 を返す
+func blobWithETag(c echo.Context, contentType string, body []byte) error {
+	etag := strongETag(body)
+	c.Response().Header().Set("ETag", etag)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, contentType, body)
+}
+
+// dataVersion 椅子、物件それぞれのデータが更新されるたびに進むバージョンと更新時刻を持っている
+type dataVersion struct {
+	mu       sync.RWMutex
+	seq      uint64
+	modified time.Time
+	// versions modified と同じ秒にできたバージョンの数
+	versions int
+}
+
+var chairDataVersion = newDataVersion()
+var estateDataVersion = newDataVersion()
+
+// bootID プロセスごとにバージョンが重複しないようにETagに含める
+var bootID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+func newDataVersion() *dataVersion {
+	return &dataVersion{modified: time.Now().UTC().Truncate(time.Second), versions: 1}
+}
+
+func (v *dataVersion) bump() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.seq++
+	now := time.Now().UTC().Truncate(time.Second)
+	if now.After(v.modified) {
+		v.modified, v.versions = now, 1
+	} else {
+		v.versions++
+	}
+}
+
+// get 現在のバージョンと更新時刻、その秒に他のバージョンもあったかを返す
+func (v *dataVersion) get() (uint64, time.Time, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.seq, v.modified, v.versions > 1
+}
+
+// notModified 条件付きリクエストに対して 304 を返せるかを判定し、304 なら ETag と Last-Modified を付与する
+// そうでなければ、ハンドラが 200 を返したときだけ付与する。If-None-Match がある場合は If-Modified-Since より優先する
+func notModified(c echo.Context, v *dataVersion, key string) bool {
+	seq, modified, ambiguous := v.get()
+	etag := fmt.Sprintf(`"%s-%d-%s"`, bootID, seq, key)
+	lastModified := modified.Format(http.TimeFormat)
+
+	req := c.Request()
+	matched := ""
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		// 304 にはクライアントが持っている表現のETagを返す
+		matched = matchingETag(inm, etag)
+	} else if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		// Last-Modified は秒単位なので、同じ秒に何度も更新されているとその秒の日時を持つクライアントが最新か区別できない
+		if t, err := http.ParseTime(ims); err == nil && (modified.Before(t) || (modified.Equal(t) && !ambiguous)) {
+			matched = etag
+		}
+	}
+	if matched != "" {
+		header := c.Response().Header()
+		header.Set("ETag", matched)
+		header.Set("Last-Modified", lastModified)
+		return true
+	}
+
+	res := c.Response()
+	res.Writer = &validatorWriter{ResponseWriter: res.Writer, etag: etag, lastModified: lastModified}
+	return false
+}
+
+// validatorWriter レスポンスが 200 のときだけ ETag と Last-Modified を付ける
+// 404 に付けると、存在しないものへの条件付きリクエストに後から 304 を返してしまう
+type validatorWriter struct {
+	http.ResponseWriter
+	etag         string
+	lastModified string
+}
+
+func (w *validatorWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		h := w.Header()
+		etag := w.etag
+		if coding := h.Get(echo.HeaderContentEncoding); coding != "" {
+			// 圧縮した表現は圧縮前の表現と区別する
+			etag = codedETag(etag, coding)
+		}
+		h.Set("ETag", etag)
+		h.Set("Last-Modified", w.lastModified)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func Test_NotModifiedSetsValidatorsOnlyOnOK(t *testing.T) {
+	v := newDataVersion()
+	e := echo.New()
+	e.GET("/api/chair/:id", func(c echo.Context) error {
+		if notModified(c, v, "chair-"+c.Param("id")) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		if c.Param("id") == "404" {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return c.JSON(http.StatusOK, map[string]int{"id": 1})
+	})
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	ok := get("/api/chair/1", "")
+	etag := ok.Header().Get("ETag")
+	if ok.Code != http.StatusOK || etag == "" || ok.Header().Get("Last-Modified") == "" {
+		t.Fatalf("200 = %d, ETag %q, Last-Modified %q", ok.Code, etag, ok.Header().Get("Last-Modified"))
+	}
+	if rec := get("/api/chair/1", etag); rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != etag {
+		t.Errorf("conditional = %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	missing := get("/api/chair/404", "")
+	if missing.Code != http.StatusNotFound || missing.Header().Get("ETag") != "" || missing.Header().Get("Last-Modified") != "" {
+		t.Errorf("404 = %d with ETag %q, Last-Modified %q", missing.Code, missing.Header().Get("ETag"), missing.Header().Get("Last-Modified"))
+	}
+}
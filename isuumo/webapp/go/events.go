@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// イベントの種類
+const (
+	EventChairCreated  = "chair.created"
+	EventEstateCreated = "estate.created"
+	EventChairStock    = "chair.stock"
+	EventChairSoldOut  = "chair.sold_out"
+	EventEstateStatus  = "estate.status"
+	EventReset         = "listings.reset"
+	// EventGap Last-Event-ID より後のイベントの一部がすでにリングバッファから消えているか、再起動をまたいで分からない
+	EventGap = "stream.gap"
+)
+
+// eventSubscriberBuffer 購読者ごとに溜めておけるイベントの数。溢れた購読者は切断し、Last-Event-ID で再開してもらう
+const eventSubscriberBuffer = 256
+
+// ListingEvent /api/events で配信する椅子や物件の変更
+// SSE のイベントIDは "<起動ごとのID>-<通し番号>" で、通し番号は起動ごとに1から振り直す
+type ListingEvent struct {
+	ID        int64           `json:"-"`
+	Type      string          `json:"type"`
+	Kind      string          `json:"kind,omitempty"`
+	ListingID int64           `json:"id,omitempty"`
+	Listing   json.RawMessage `json:"listing,omitempty"`
+	Stock     *int64          `json:"stock,omitempty"`
+	Status    string          `json:"status,omitempty"`
+	Time      time.Time       `json:"time"`
+
+	epoch string
+
+	// 検索条件での絞り込みに使う。分からない場合は nil
+	chair  *Chair
+	estate *Estate
+}
+
+// EventHub 最近のイベントを固定長のリングバッファに持ち、購読者に配る
+type EventHub struct {
+	mu     sync.Mutex
+	ring   []ListingEvent
+	epoch  string
+	seq    int64
+	subs   map[*eventSubscriber]struct{}
+	closed bool
+
+	published int64
+	dropped   int64
+}
+
+type eventSubscriber struct {
+	ch     chan ListingEvent
+	filter func(ListingEvent) bool
+}
+
+var eventHub = NewEventHub(1024)
+
+func NewEventHub(size int) *EventHub {
+	return &EventHub{ring: make([]ListingEvent, size), epoch: bootID, subs: map[*eventSubscriber]struct{}{}}
+}
+
+// Publish イベントに通し番号を振って配る
+func (h *EventHub) Publish(events ...ListingEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range events {
+		h.seq++
+		ev.ID, ev.epoch = h.seq, h.epoch
+		if ev.Time.IsZero() {
+			ev.Time = time.Now()
+		}
+		h.ring[ev.ID%int64(len(h.ring))] = ev
+		h.published++
+		for sub := range h.subs {
+			if sub.filter != nil && !sub.filter(ev) {
+				continue
+			}
+			select {
+			case sub.ch <- ev:
+			default:
+				close(sub.ch)
+				delete(h.subs, sub)
+				h.dropped++
+			}
+		}
+	}
+}
+
+// Subscribe epoch と lastID で指定したイベントより後のものでリングバッファに残っているものと、以降のイベントを受け取るチャネルを返す
+// epoch が空なら以降のイベントだけを返す。欠けたイベントがある場合は gap を true にする。停止中は nil を返す
+func (h *EventHub) Subscribe(epoch string, lastID int64, filter func(ListingEvent) bool) (backlog []ListingEvent, gap bool, sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false, nil
+	}
+	start := h.seq + 1
+	switch {
+	case epoch == "":
+	case epoch != h.epoch:
+		// 前の起動で最後に受け取ったイベントより後のものは失われているので、今回の起動のイベントを残っている分だけ返す
+		gap, start = true, 1
+	case lastID > h.seq:
+		gap = true
+	default:
+		start = lastID + 1
+	}
+	if start <= h.seq {
+		oldest := h.seq - int64(len(h.ring)) + 1
+		if oldest < 1 {
+			oldest = 1
+		}
+		if start < oldest {
+			gap = true
+			start = oldest
+		}
+		for id := start; id <= h.seq; id++ {
+			ev := h.ring[id%int64(len(h.ring))]
+			if filter == nil || filter(ev) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	sub = &eventSubscriber{ch: make(chan ListingEvent, eventSubscriberBuffer), filter: filter}
+	h.subs[sub] = struct{}{}
+	return backlog, gap, sub
+}
+
+func (h *EventHub) Unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		close(sub.ch)
+		delete(h.subs, sub)
+	}
+}
+
+// Close シャットダウン時に配信中のストリームを終わらせる
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		close(sub.ch)
+		delete(h.subs, sub)
+	}
+}
+
+func (h *EventHub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// recordChanges 変更を監査ログに残し、購読者にイベントとして配る。新しく投入されたものは保存した検索条件とも照らし合わせる
+func recordChanges(entries ...ChangeAuditEntry) {
+	changeAudit.record(entries...)
+	events := changeEvents(entries)
+	eventHub.Publish(events...)
+	savedSearches.notify(events)
+}
+
+// changeEvents 変更からイベントを作る。住所の補完のような件数の多い内部の更新は配信しない
+func changeEvents(entries []ChangeAuditEntry) []ListingEvent {
+	events := []ListingEvent{}
+	for _, e := range entries {
+		ev := ListingEvent{Kind: e.Kind, ListingID: e.ListingID, Time: e.Time}
+		switch {
+		case e.Action == ChangeImport && e.Kind == listingKindChair:
+			chair := chairFromRecord(e.After)
+			ev.Type, ev.chair = EventChairCreated, &chair
+			ev.Listing, _ = chair.fragment()
+		case e.Action == ChangeImport && e.Kind == listingKindEstate:
+			estate := estateFromRecord(e.After)
+			ev.Type, ev.estate = EventEstateCreated, &estate
+			ev.Listing, _ = estate.fragment()
+		case e.Action == ChangePurchase:
+			stock := e.After["stock"].(int64)
+			ev.Type, ev.Stock, ev.chair = EventChairStock, &stock, cachedChair(e.ListingID)
+			events = append(events, ev)
+			if stock > 0 {
+				continue
+			}
+			ev.Type = EventChairSoldOut
+		case e.Action == ChangeStatusChange:
+			ev.Type, ev.Status = EventEstateStatus, e.After["status"].(string)
+			ev.estate = cachedEstate(e.ListingID)
+		case e.Action == ChangeReset:
+			ev.Type, ev.ListingID = EventReset, 0
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// cachedChair 購入のように属性を読み込まない変更でも検索条件で絞り込めるよう、JSONの断片から椅子を戻す
+func cachedChair(id int64) *Chair {
+	b, ok := chairFragments.lookup(id)
+	if !ok {
+		return nil
+	}
+	var chair Chair
+	if err := json.Unmarshal(b, &chair); err != nil {
+		return nil
+	}
+	return &chair
+}
+
+func cachedEstate(id int64) *Estate {
+	b, ok := estateFragments.lookup(id)
+	if !ok {
+		return nil
+	}
+	var estate Estate
+	if err := json.Unmarshal(b, &estate); err != nil {
+		return nil
+	}
+	return &estate
+}
+
+// eventFilter ?listing=chair|estate, ?types=chair.created,chair.sold_out と、各検索と同じクエリパラメータで絞り込む
+// 検索条件を指定した場合、属性の分からない椅子や物件のイベントは配信しない
+func eventFilter(c echo.Context) (func(ListingEvent) bool, error) {
+	q := c.QueryParams()
+	listing := q.Get("listing")
+	if listing != "" && listing != listingKindChair && listing != listingKindEstate {
+		return nil, fmt.Errorf("invalid listing %q", listing)
+	}
+	types := map[string]bool{}
+	for _, t := range strings.Split(q.Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	chairOK, err := chairMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+	estateOK, err := estateMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+	hasChairCondition, hasEstateCondition := false, false
+	for _, p := range []string{"priceRangeId", "heightRangeId", "widthRangeId", "depthRangeId", "kind", "color"} {
+		hasChairCondition = hasChairCondition || q.Get(p) != ""
+	}
+	for _, p := range []string{"doorHeightRangeId", "doorWidthRangeId", "rentRangeId", "prefecture", "city"} {
+		hasEstateCondition = hasEstateCondition || q.Get(p) != ""
+	}
+	hasFeatures := q.Get("features") != ""
+
+	return func(ev ListingEvent) bool {
+		if ev.Type == EventReset {
+			return true
+		}
+		if listing != "" && ev.Kind != listing {
+			return false
+		}
+		if len(types) > 0 && !types[ev.Type] {
+			return false
+		}
+		switch ev.Kind {
+		case listingKindChair:
+			if hasChairCondition || hasFeatures {
+				return ev.chair != nil && chairOK(*ev.chair)
+			}
+		case listingKindEstate:
+			if hasEstateCondition || hasFeatures {
+				return ev.estate != nil && estateOK(*ev.estate)
+			}
+		}
+		return true
+	}, nil
+}
+
+func writeEvent(res *echo.Response, ev ListingEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if ev.ID > 0 {
+		fmt.Fprintf(res, "id: %s-%d\n", ev.epoch, ev.ID)
+	}
+	_, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", ev.Type, b)
+	return err
+}
+
+// parseEventID "<起動ごとのID>-<通し番号>" を分ける。起動ごとのIDのない古い形式は別の起動のイベントとして扱う
+func parseEventID(id string) (string, int64, error) {
+	if id == "" {
+		return "", 0, nil
+	}
+	epoch, seq := "-", id
+	if i := strings.LastIndex(id, "-"); i >= 0 {
+		epoch, seq = id[:i], id[i+1:]
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || epoch == "" || n < 0 {
+		return "", 0, fmt.Errorf("malformed event id %q", id)
+	}
+	return epoch, n, nil
+}
+
+// getEvents Server-Sent Events で椅子や物件の変更を配信する
+// 再接続時は Last-Event-ID ヘッダか lastEventId クエリパラメータの続きから配信する
+func getEvents(c echo.Context) error {
+	filter, err := eventFilter(c)
+	if err != nil {
+		c.Echo().Logger.Infof("invalid event filter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("lastEventId")
+	}
+	epoch, lastID, err := parseEventID(lastEventID)
+	if err != nil {
+		c.Echo().Logger.Infof("invalid Last-Event-ID : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	backlog, gap, sub := eventHub.Subscribe(epoch, lastID, filter)
+	if sub == nil {
+		return c.NoContent(http.StatusServiceUnavailable)
+	}
+	defer eventHub.Unsubscribe(sub)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// nginx にバッファリングさせずにそのまま流す
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	if gap {
+		if err := writeEvent(res, ListingEvent{Type: EventGap, Time: time.Now()}); err != nil {
+			return nil
+		}
+	}
+	for _, ev := range backlog {
+		if err := writeEvent(res, ev); err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(config.Events.Heartbeat))
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return nil
+			}
+			if err := writeEvent(res, ev); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case <-c.Request().Context().Done():
+			return nil
+		}
+		res.Flush()
+	}
+}
+
+func (h *EventHub) stats() (published, dropped int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.published, h.dropped
+}
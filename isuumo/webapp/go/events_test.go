@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func publishChairEvents(h *EventHub, n int) {
+	for i := 0; i < n; i++ {
+		h.Publish(ListingEvent{Type: EventChairCreated, Kind: listingKindChair, ListingID: int64(i + 1)})
+	}
+}
+
+func eventSeqs(events []ListingEvent) []int64 {
+	ids := []int64{}
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+	}
+	return ids
+}
+
+func Test_EventHubSubscribeGaps(t *testing.T) {
+	h := NewEventHub(4)
+	publishChairEvents(h, 6)
+
+	for _, tc := range []struct {
+		name    string
+		epoch   string
+		lastID  int64
+		backlog []int64
+		gap     bool
+	}{
+		{"new stream", "", 0, []int64{}, false},
+		{"up to date", bootID, 6, []int64{}, false},
+		{"within the ring", bootID, 4, []int64{5, 6}, false},
+		{"oldest retained", bootID, 2, []int64{3, 4, 5, 6}, false},
+		{"evicted", bootID, 1, []int64{3, 4, 5, 6}, true},
+		// 通し番号は起動ごとに振り直すので、前の起動のIDは数字が小さくても続きとして扱えない
+		{"previous boot", "previous", 5, []int64{3, 4, 5, 6}, true},
+		{"ahead of this boot", bootID, 9, []int64{}, true},
+	} {
+		backlog, gap, sub := h.Subscribe(tc.epoch, tc.lastID, nil)
+		h.Unsubscribe(sub)
+		if got := eventSeqs(backlog); !reflect.DeepEqual(got, tc.backlog) || gap != tc.gap {
+			t.Errorf("%v: backlog = %v, gap = %v, want %v, %v", tc.name, got, gap, tc.backlog, tc.gap)
+		}
+	}
+
+	// 前の起動のIDでも、今回の起動のイベントがすべて残っていれば最初から返す
+	h = NewEventHub(8)
+	publishChairEvents(h, 3)
+	backlog, gap, sub := h.Subscribe("previous", 100, nil)
+	h.Unsubscribe(sub)
+	if got := eventSeqs(backlog); !reflect.DeepEqual(got, []int64{1, 2, 3}) || !gap {
+		t.Errorf("previous boot: backlog = %v, gap = %v", got, gap)
+	}
+}
+
+func Test_EventHubSubscribeFiltersBacklogAndLiveEvents(t *testing.T) {
+	h := NewEventHub(8)
+	h.Publish(
+		ListingEvent{Type: EventChairCreated, Kind: listingKindChair, ListingID: 1},
+		ListingEvent{Type: EventEstateCreated, Kind: listingKindEstate, ListingID: 2},
+	)
+	onlyEstates := func(ev ListingEvent) bool { return ev.Kind == listingKindEstate }
+	backlog, _, sub := h.Subscribe(bootID, 0, onlyEstates)
+	defer h.Unsubscribe(sub)
+	if len(backlog) != 1 || backlog[0].ListingID != 2 {
+		t.Errorf("backlog = %+v", backlog)
+	}
+	h.Publish(
+		ListingEvent{Type: EventChairCreated, Kind: listingKindChair, ListingID: 3},
+		ListingEvent{Type: EventEstateCreated, Kind: listingKindEstate, ListingID: 4},
+	)
+	if ev := <-sub.ch; ev.ListingID != 4 || ev.ID != 4 {
+		t.Errorf("live event = %+v", ev)
+	}
+}
+
+func Test_EventHubDropsSlowSubscribers(t *testing.T) {
+	h := NewEventHub(8)
+	_, _, sub := h.Subscribe("", 0, nil)
+	publishChairEvents(h, eventSubscriberBuffer+1)
+	n := 0
+	for range sub.ch {
+		n++
+	}
+	if n != eventSubscriberBuffer || h.Subscribers() != 0 {
+		t.Errorf("received %d events, %d subscribers left", n, h.Subscribers())
+	}
+	if _, dropped := h.stats(); dropped != 1 {
+		t.Errorf("dropped = %d", dropped)
+	}
+}
+
+func Test_ParseEventID(t *testing.T) {
+	for _, tc := range []struct {
+		id     string
+		epoch  string
+		lastID int64
+		ok     bool
+	}{
+		{"", "", 0, true},
+		{"kf3x9a-42", "kf3x9a", 42, true},
+		// 起動ごとのIDのない古い形式は、どの起動とも一致しない
+		{"42", "-", 42, true},
+		{"kf3x9a-", "", 0, false},
+		{"-42", "", 0, false},
+		{"kf3x9a-x", "", 0, false},
+		{"kf3x9a-1.5", "", 0, false},
+	} {
+		epoch, lastID, err := parseEventID(tc.id)
+		if (err == nil) != tc.ok || (tc.ok && (epoch != tc.epoch || lastID != tc.lastID)) {
+			t.Errorf("parseEventID(%q) = %q, %d, %v", tc.id, epoch, lastID, err)
+		}
+	}
+}
+
+func Test_WriteEventUsesBootPrefixedIDs(t *testing.T) {
+	h := NewEventHub(4)
+	h.Publish(ListingEvent{Type: EventChairSoldOut, Kind: listingKindChair, ListingID: 7})
+	backlog, _, sub := h.Subscribe(bootID, 0, nil)
+	h.Unsubscribe(sub)
+
+	rec := httptest.NewRecorder()
+	res := echo.NewResponse(rec, echo.New())
+	if err := writeEvent(res, backlog[0]); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "id: "+bootID+"-1\nevent: chair.sold_out\ndata: ") {
+		t.Errorf("event = %q", rec.Body.String())
+	}
+	epoch, lastID, err := parseEventID(bootID + "-1")
+	if err != nil || epoch != bootID || lastID != 1 {
+		t.Errorf("the written id must parse back: %q, %d, %v", epoch, lastID, err)
+	}
+}
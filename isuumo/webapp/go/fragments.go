@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo"
+)
+
+// FragmentStore 椅子や物件ごとにエンコード済みのJSONを持ち、レスポンスはそのバイト列をつなげて組み立てる
+// 断片には更新されうる項目から作ったスタンプを添え、読み込んだレコードとスタンプが違えばエンコードし直す
+type FragmentStore struct {
+	mu     sync.RWMutex
+	frags  map[int64]fragment
+	hits   int64
+	misses int64
+}
+
+type fragment struct {
+	stamp string
+	body  []byte
+}
+
+var chairFragments = NewFragmentStore()
+var estateFragments = NewFragmentStore()
+
+func NewFragmentStore() *FragmentStore {
+	return &FragmentStore{frags: map[int64]fragment{}}
+}
+
+func (s *FragmentStore) get(id int64, stamp string, v interface{}) ([]byte, error) {
+	s.mu.RLock()
+	f, ok := s.frags[id]
+	s.mu.RUnlock()
+	if ok && f.stamp == stamp {
+		atomic.AddInt64(&s.hits, 1)
+		return f.body, nil
+	}
+	atomic.AddInt64(&s.misses, 1)
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.frags[id] = fragment{stamp: stamp, body: b}
+	s.mu.Unlock()
+	return b, nil
+}
+
+// Reset /initialize でデータを入れ直すと同じIDが別の内容になりうるため、すべて捨てる
+func (s *FragmentStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frags = map[int64]fragment{}
+}
+
+// lookup エンコード済みの断片があれば返す。なければエンコードせずに false を返す
+func (s *FragmentStore) lookup(id int64) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.frags[id]
+	return f.body, ok
+}
+
+func (s *FragmentStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.frags)
+}
+
+// fragment 椅子のJSONに出る項目は登録後に変わらないためスタンプは使わない
+func (chair Chair) fragment() ([]byte, error) {
+	return chairFragments.get(chair.ID, "", chair)
+}
+
+// fragment 物件は状態の遷移と住所の補完でJSONに出る項目が変わる
+func (estate Estate) fragment() ([]byte, error) {
+	stamp := estate.Status + "\x00" + estate.Prefecture + "\x00" + estate.City
+	if estate.StatusChangedAt != nil {
+		stamp += "\x00" + strconv.FormatInt(estate.StatusChangedAt.UnixNano(), 10)
+	}
+	return estateFragments.get(estate.ID, stamp, estate)
+}
+
+// listJSON {"count":N,"<key>":[...]} の形で断片をつなげる。withCount が false なら count を出さない
+// 件数が0でも null ではなく空の配列を返す
+func listJSON(key string, withCount bool, count int64, n int, frag func(i int) ([]byte, error)) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	if withCount {
+		buf.WriteString(`"count":`)
+		buf.WriteString(strconv.FormatInt(count, 10))
+		buf.WriteByte(',')
+	}
+	buf.WriteByte('"')
+	buf.WriteString(key)
+	buf.WriteString(`":[`)
+	for i := 0; i < n; i++ {
+		b, err := frag(i)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(b)
+	}
+	buf.WriteString("]}")
+	return buf.Bytes(), nil
+}
+
+func chairListJSON(withCount bool, count int64, chairs []Chair) ([]byte, error) {
+	return listJSON("chairs", withCount, count, len(chairs), func(i int) ([]byte, error) {
+		return chairs[i].fragment()
+	})
+}
+
+func estateListJSON(withCount bool, count int64, estates []Estate) ([]byte, error) {
+	return listJSON("estates", withCount, count, len(estates), func(i int) ([]byte, error) {
+		return estates[i].fragment()
+	})
+}
+
+// fragmentResponse 断片からレスポンスを組み立てる時間をスパンとして記録しつつ返す
+func fragmentResponse(c echo.Context, build func() ([]byte, error)) error {
+	_, span := startSpan(c.Request().Context(), "json.assemble", SpanKindInternal)
+	b, err := build()
+	span.SetAttribute("json.bytes", len(b))
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, http.StatusOK, b)
+}
+
+// preloadFragments 起動時と /initialize の後に全件のJSONを作っておく
+func preloadFragments(ctx context.Context) error {
+	chairFragments.Reset()
+	estateFragments.Reset()
+
+	err := dbChair.scatter(ctx, func(ctx context.Context, _ int, shard *Cluster) error {
+		chairs := []Chair{}
+		if err := shard.SelectContext(ctx, &chairs, "SELECT * FROM chair"); err != nil {
+			return err
+		}
+		for _, chair := range chairs {
+			if _, err := chair.fragment(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	estates := []Estate{}
+	if err := dbEstate.SelectContext(ctx, &estates, "SELECT * FROM estate"); err != nil {
+		return err
+	}
+	for _, estate := range estates {
+		if _, err := estate.fragment(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const GeoJSONMIMEType = "application/geo+json"
+
+type GeoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         int64                  `json:"id"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+	Count    *int64           `json:"count,omitempty"`
+}
+
+// newGeoJSONPoint GeoJSONの座標は経度、緯度の順で持つ
+func newGeoJSONPoint(c Coordinate) GeoJSONGeometry {
+	coordinates, _ := json.Marshal([2]float64{c.Longitude, c.Latitude})
+	return GeoJSONGeometry{Type: "Point", Coordinates: coordinates}
+}
+
+func newGeoJSONFeatureCollection(features []GeoJSONFeature) GeoJSONFeatureCollection {
+	if features == nil {
+		features = []GeoJSONFeature{}
+	}
+	return GeoJSONFeatureCollection{Type: "FeatureCollection", Features: features}
+}
+
+func (e Estate) toGeoJSONFeature(properties map[string]interface{}) GeoJSONFeature {
+	return GeoJSONFeature{
+		Type:       "Feature",
+		ID:         e.ID,
+		Geometry:   newGeoJSONPoint(Coordinate{Latitude: e.Latitude, Longitude: e.Longitude}),
+		Properties: properties,
+	}
+}
+
+// GeoJSONPolygon 外周と穴のリングを持つ。リング内の座標は経度、緯度の順
+type GeoJSONPolygon [][][2]float64
+
+// nazotteRequest 旧形式の {"coordinates":[{latitude,longitude}]} とGeoJSONのGeometry、Featureを受け付ける
+type nazotteRequest struct {
+	Type        string           `json:"type"`
+	Coordinates json.RawMessage  `json:"coordinates"`
+	Geometry    *GeoJSONGeometry `json:"geometry"`
+}
+
+// Polygon 外周と穴のリングを緯度経度で持つ
+type Polygon [][]Coordinate
+
+type MultiPolygon []Polygon
+
+func (cs Coordinates) toMultiPolygon() MultiPolygon {
+	return MultiPolygon{Polygon{cs.Coordinates}}
+}
+
+func (p GeoJSONPolygon) toPolygon() (Polygon, error) {
+	if len(p) == 0 {
+		return nil, fmt.Errorf("polygon has no ring")
+	}
+	polygon := make(Polygon, 0, len(p))
+	for _, ring := range p {
+		if len(ring) < 3 {
+			return nil, fmt.Errorf("ring must have at least 3 positions")
+		}
+		coordinates := make([]Coordinate, 0, len(ring)+1)
+		for _, position := range ring {
+			coordinates = append(coordinates, Coordinate{Latitude: position[1], Longitude: position[0]})
+		}
+		if coordinates[0] != coordinates[len(coordinates)-1] {
+			coordinates = append(coordinates, coordinates[0])
+		}
+		polygon = append(polygon, coordinates)
+	}
+	return polygon, nil
+}
+
+func parseGeoJSONGeometry(g GeoJSONGeometry) (MultiPolygon, error) {
+	switch g.Type {
+	case "Polygon":
+		var p GeoJSONPolygon
+		if err := json.Unmarshal(g.Coordinates, &p); err != nil {
+			return nil, err
+		}
+		polygon, err := p.toPolygon()
+		if err != nil {
+			return nil, err
+		}
+		return MultiPolygon{polygon}, nil
+	case "MultiPolygon":
+		var mp []GeoJSONPolygon
+		if err := json.Unmarshal(g.Coordinates, &mp); err != nil {
+			return nil, err
+		}
+		if len(mp) == 0 {
+			return nil, fmt.Errorf("multipolygon has no polygon")
+		}
+		multiPolygon := make(MultiPolygon, 0, len(mp))
+		for _, p := range mp {
+			polygon, err := p.toPolygon()
+			if err != nil {
+				return nil, err
+			}
+			multiPolygon = append(multiPolygon, polygon)
+		}
+		return multiPolygon, nil
+	default:
+		return nil, fmt.Errorf("unsupported geometry type: %v", g.Type)
+	}
+}
+
+func parseNazotteRequest(body []byte) (MultiPolygon, error) {
+	req := nazotteRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	switch req.Type {
+	case "":
+		coordinates := Coordinates{}
+		if err := json.Unmarshal(body, &coordinates); err != nil {
+			return nil, err
+		}
+		if len(coordinates.Coordinates) == 0 {
+			return nil, fmt.Errorf("coordinates is empty")
+		}
+		return coordinates.toMultiPolygon(), nil
+	case "Feature":
+		if req.Geometry == nil {
+			return nil, fmt.Errorf("feature has no geometry")
+		}
+		return parseGeoJSONGeometry(*req.Geometry)
+	default:
+		return parseGeoJSONGeometry(GeoJSONGeometry{Type: req.Type, Coordinates: req.Coordinates})
+	}
+}
+
+// toText estate.point (POINT(latitude, longitude)) と比較できるWKTを返す
+func (mp MultiPolygon) toText() string {
+	polygons := make([]string, 0, len(mp))
+	for _, polygon := range mp {
+		rings := make([]string, 0, len(polygon))
+		for _, ring := range polygon {
+			points := make([]string, 0, len(ring))
+			for _, c := range ring {
+				points = append(points, fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
+			}
+			rings = append(rings, "("+strings.Join(points, ",")+")")
+		}
+		polygons = append(polygons, "("+strings.Join(rings, ",")+")")
+	}
+	if len(polygons) == 1 {
+		return "POLYGON" + polygons[0]
+	}
+	return "MULTIPOLYGON(" + strings.Join(polygons, ",") + ")"
+}
+
+// acceptsGeoJSON Accept ヘッダで application/geo+json が要求されているか
+func acceptsGeoJSON(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), GeoJSONMIMEType)
+}
+
+func geoJSON(c echo.Context, code int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Blob(code, GeoJSONMIMEType, body)
+}
+
+// geoJSONProperties 座標以外の項目をFeatureのpropertiesとして返す
+func (e Estate) geoJSONProperties() map[string]interface{} {
+	properties := map[string]interface{}{}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return properties
+	}
+	json.Unmarshal(b, &properties)
+	delete(properties, "latitude")
+	delete(properties, "longitude")
+	return properties
+}
+
+func (res EstateSearchResponse) toGeoJSON() GeoJSONFeatureCollection {
+	features := make([]GeoJSONFeature, 0, len(res.Estates))
+	for _, estate := range res.Estates {
+		features = append(features, estate.toGeoJSONFeature(estate.geoJSONProperties()))
+	}
+	fc := newGeoJSONFeatureCollection(features)
+	count := res.Count
+	fc.Count = &count
+	return fc
+}
+
+// estateSearchResult Accept ヘッダに応じて物件一覧をJSONかGeoJSONで返す
+func estateSearchResult(c echo.Context, res EstateSearchResponse) error {
+	if acceptsGeoJSON(c) {
+		return geoJSON(c, http.StatusOK, res.toGeoJSON())
+	}
+	return fragmentResponse(c, func() ([]byte, error) {
+		return estateListJSON(true, res.Count, res.Estates)
+	})
+}
@@ -3,6 +3,7 @@ module github.com/isucon/isucon10-qualify/isuumo
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/eko/gocache v1.2.0 // indirect
@@ -11,8 +12,8 @@ require (
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/labstack/gommon v0.3.0
 	github.com/mattn/go-colorable v0.1.6 // indirect
-	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
-	github.com/sevenNt/echo-pprof v0.1.0 // indirect
+	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/sevenNt/echo-pprof v0.1.0
 	github.com/stretchr/testify v1.7.0
 	github.com/valyala/fasttemplate v1.1.0 // indirect
 	gopkg.in/yaml.v2 v2.3.0 // indirect
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// readinessPingTimeout /readyz でDBの疎通を確認するときの締め切り
+const readinessPingTimeout = 500 * time.Millisecond
+
+// Readiness nginx からの振り分けを受けてよい状態かを表す
+type Readiness struct {
+	initializing int32
+	warm         int32
+	draining     int32
+}
+
+var readiness = &Readiness{}
+
+type ReadinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// beginInitialize /initialize の実行中はデータが揃っていないため ready にしない
+func (r *Readiness) beginInitialize() {
+	atomic.AddInt32(&r.initializing, 1)
+	atomic.StoreInt32(&r.warm, 0)
+}
+
+func (r *Readiness) endInitialize() {
+	atomic.AddInt32(&r.initializing, -1)
+}
+
+func (r *Readiness) setWarm() {
+	atomic.StoreInt32(&r.warm, 1)
+}
+
+func (r *Readiness) setDraining() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+// warmUp インデックスをバッファプールに載せ、レスポンスのJSONの断片とよく参照されるキャッシュを埋め直す
+func warmUp(ctx context.Context) error {
+	err := dbChair.scatter(ctx, func(ctx context.Context, _ int, shard *Cluster) error {
+		var n int64
+		return shard.GetContext(ctx, &n, "SELECT COUNT(*) FROM chair")
+	})
+	if err != nil {
+		return err
+	}
+	var n int64
+	if err := dbEstate.GetContext(ctx, &n, "SELECT COUNT(*) FROM estate"); err != nil {
+		return err
+	}
+
+	if err := preloadFragments(ctx); err != nil {
+		return err
+	}
+
+	chairCacheManager.Flush()
+	estateCacheManager.Flush()
+
+	chairs, err := lowPricedChairs(ctx)
+	if err != nil {
+		return err
+	}
+	chairCacheManager.Set(lowPricedCacheKey, chairs, gocache.DefaultExpiration)
+
+	estates := []Estate{}
+	if err := stmtGetLowPricedEstate.SelectContext(ctx, &estates, config.Search.Limit); err != nil {
+		return err
+	}
+	estateCacheManager.Set(lowPricedCacheKey, estates, gocache.DefaultExpiration)
+
+	if _, err := getRegionCondition(ctx); err != nil {
+		return err
+	}
+	readiness.setWarm()
+	return nil
+}
+
+func getHealthz(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+func getReadyz(c echo.Context) error {
+	res := ReadinessResponse{Ready: true, Checks: map[string]string{}}
+	fail := func(name, reason string) {
+		res.Ready = false
+		res.Checks[name] = reason
+	}
+
+	if atomic.LoadInt32(&readiness.draining) == 1 {
+		fail("shutdown", "draining")
+	}
+	if atomic.LoadInt32(&readiness.initializing) > 0 {
+		fail("initialize", "in progress")
+	} else {
+		res.Checks["initialize"] = "ok"
+	}
+	if atomic.LoadInt32(&readiness.warm) == 0 {
+		fail("warm", "caches are cold")
+	} else {
+		res.Checks["warm"] = "ok"
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessPingTimeout)
+	defer cancel()
+	for name, db := range map[string]interface {
+		PingContext(ctx context.Context) error
+	}{"chairDB": dbChair, "estateDB": dbEstate} {
+		if err := db.PingContext(ctx); err != nil {
+			fail(name, err.Error())
+		} else {
+			res.Checks[name] = "ok"
+		}
+	}
+
+	if !res.Ready {
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// startServer SIGTERM, SIGINT を受けたら ready を落とし、処理中のリクエストを待ってから戻る
+func startServer(e *echo.Echo, address string, timeout time.Duration) {
+	go func() {
+		if err := e.Start(address); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
+	sig := <-quit
+	e.Logger.Infof("received %v, shutting down", sig)
+	readiness.setDraining()
+	// 配信中のイベントのストリームは終わらないため、先に閉じておかないと Shutdown が締め切りまで待ってしまう
+	eventHub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Errorf("graceful shutdown failed : %v", err)
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+const (
+	listingKindChair  = "chair"
+	listingKindEstate = "estate"
+)
+
+const (
+	ImportJobQueued    = "queued"
+	ImportJobRunning   = "running"
+	ImportJobSucceeded = "succeeded"
+	ImportJobFailed    = "failed"
+)
+
+// importBatchTimeout 1バッチの投入にかける締め切り
+const importBatchTimeout = 30 * time.Second
+
+// maxImportRowErrors ジョブごとに記録する行のエラーの上限。超えた分は failedRows にだけ数える
+const maxImportRowErrors = 100
+
+// mysqlErrDupEntry 主キーの重複
+const mysqlErrDupEntry = 1062
+
+// ImportJob 非同期で投入しているCSVの進み具合。ジャーナルにもこの形で記録する
+type ImportJob struct {
+	ID            string           `json:"id"`
+	Kind          string           `json:"kind"`
+	State         string           `json:"state"`
+	TotalRows     int              `json:"totalRows"`
+	ProcessedRows int              `json:"processedRows"`
+	InsertedRows  int              `json:"insertedRows"`
+	FailedRows    int              `json:"failedRows"`
+	Errors        []ImportRowError `json:"errors"`
+	Error         string           `json:"error,omitempty"`
+	Actor         string           `json:"actor"`
+	RequestID     string           `json:"requestId"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	UpdatedAt     time.Time        `json:"updatedAt"`
+
+	// resumed 前回の起動で実行中だった。最初のバッチは投入した後、ジャーナルに記録する前に止まった可能性がある
+	resumed bool
+}
+
+// ImportRowError Row はCSVの1始まりの行番号
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+func (job *ImportJob) finished() bool {
+	return job.State == ImportJobSucceeded || job.State == ImportJobFailed
+}
+
+func (job *ImportJob) addRowError(e ImportRowError) {
+	job.FailedRows++
+	if len(job.Errors) < maxImportRowErrors {
+		job.Errors = append(job.Errors, e)
+	}
+}
+
+// ImportQueue アップロードされたCSVをディレクトリに保存し、決まった数のワーカーでバッチごとに投入する
+// バッチを投入するたびにジョブの状態をジャーナルに追記して fsync し、再起動時には未完了のジョブを続きから再開する
+// 終わったジョブは ttl が過ぎたら忘れる
+type ImportQueue struct {
+	dir       string
+	batchSize int
+	ttl       time.Duration
+
+	mu          sync.Mutex
+	jobs        map[string]*ImportJob
+	journal     *os.File
+	journalSize int64
+
+	queue chan string
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+var importQueue *ImportQueue
+
+// NewImportQueue dir が空なら非同期の投入は使わず、アップロードはすべてリクエストの中で投入する
+func NewImportQueue(dir string, workers, queueSize, batchSize int, ttl time.Duration) (*ImportQueue, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &ImportQueue{
+		dir:       dir,
+		batchSize: batchSize,
+		ttl:       ttl,
+		jobs:      map[string]*ImportJob{},
+		done:      make(chan struct{}),
+	}
+	pending, err := q.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(q.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	q.journal, q.journalSize = f, info.Size()
+
+	if len(pending) > queueSize {
+		queueSize = len(pending)
+	}
+	q.queue = make(chan string, queueSize)
+	for _, id := range pending {
+		q.queue <- id
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	return q, nil
+}
+
+func (q *ImportQueue) journalPath() string {
+	return filepath.Join(q.dir, "journal.jsonl")
+}
+
+func (q *ImportQueue) csvPath(id string) string {
+	return filepath.Join(q.dir, id+".csv")
+}
+
+// replay ジャーナルの各ジョブの最後の状態を読み込み、終わっていないジョブのIDを受け付けた順に返す
+func (q *ImportQueue) replay() ([]string, error) {
+	b, err := ioutil.ReadFile(q.journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	order := []string{}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		var job ImportJob
+		if err := json.Unmarshal(line, &job); err != nil || job.ID == "" {
+			// 書き込み途中で落ちた最後の行は、その前の状態から再開すればよい
+			continue
+		}
+		if _, ok := q.jobs[job.ID]; !ok {
+			order = append(order, job.ID)
+		}
+		q.jobs[job.ID] = &job
+	}
+	q.evict(time.Now())
+	pending := []string{}
+	for _, id := range order {
+		if job, ok := q.jobs[id]; ok && !job.finished() {
+			job.resumed = job.State == ImportJobRunning
+			job.State = ImportJobQueued
+			pending = append(pending, id)
+		}
+	}
+	return pending, nil
+}
+
+// evict 終わってから ttl が過ぎたジョブを呼び出し側でロックを持ったまま忘れる。ジャーナルからは次の起動時の書き直しで消える
+func (q *ImportQueue) evict(now time.Time) {
+	for id, job := range q.jobs {
+		if job.finished() && now.Sub(job.UpdatedAt) > q.ttl {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// compact ジャーナルを各ジョブの最後の状態だけに書き直す
+func (q *ImportQueue) compact() error {
+	var buf bytes.Buffer
+	for _, job := range q.jobs {
+		b, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	tmp := q.journalPath() + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.journalPath())
+}
+
+// writeFileSync 書き込んだ内容を fsync してから閉じる
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// record ジョブの状態を呼び出し側でロックを持ったまま追記し、fsync してから返す
+// 書けなかった場合は途中まで書いた行を消し、次の追記が壊れた行に続かないようにする
+func (q *ImportQueue) record(job *ImportJob) error {
+	job.UpdatedAt = time.Now()
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = q.journal.Write(b)
+	if err == nil {
+		err = q.journal.Sync()
+	}
+	if err != nil {
+		q.journal.Truncate(q.journalSize)
+		return err
+	}
+	q.journalSize += int64(len(b))
+	return nil
+}
+
+// Submit CSVを保存してジョブを受け付ける。CSVとして読めない場合とキューが一杯の場合はエラーを返す
+// ジョブはジャーナルに記録してからキューに入れるので、受け付けたジョブは再起動しても失われない
+func (q *ImportQueue) Submit(kind, actor, requestID string, body []byte) (*ImportJob, error) {
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		return nil, errInvalidImport{err}
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileSync(q.csvPath(id), body); err != nil {
+		os.Remove(q.csvPath(id))
+		return nil, err
+	}
+	now := time.Now()
+	job := &ImportJob{
+		ID:        id,
+		Kind:      kind,
+		State:     ImportJobQueued,
+		TotalRows: len(records),
+		Errors:    []ImportRowError{},
+		Actor:     actor,
+		RequestID: requestID,
+		CreatedAt: now,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.evict(now)
+	// キューに入れるのはロックを持った Submit だけなので、ここで空きがあれば後で詰まらない
+	if len(q.queue) >= cap(q.queue) {
+		os.Remove(q.csvPath(id))
+		return nil, errImportQueueFull
+	}
+	if err := q.record(job); err != nil {
+		os.Remove(q.csvPath(id))
+		return nil, err
+	}
+	q.jobs[id] = job
+	q.queue <- id
+	copied := *job
+	return &copied, nil
+}
+
+type errInvalidImport struct {
+	err error
+}
+
+func (e errInvalidImport) Error() string {
+	return fmt.Sprintf("invalid csv: %v", e.err)
+}
+
+var errImportQueueFull = fmt.Errorf("import queue is full")
+
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Job ジョブの状態のコピーを返す
+func (q *ImportQueue) Job(id string) (ImportJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return ImportJob{}, false
+	}
+	copied := *job
+	copied.Errors = append([]ImportRowError{}, job.Errors...)
+	return copied, true
+}
+
+// StateCounts メトリクス用に状態ごとのジョブ数を返す
+func (q *ImportQueue) StateCounts() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counts := map[string]int{ImportJobQueued: 0, ImportJobRunning: 0, ImportJobSucceeded: 0, ImportJobFailed: 0}
+	for _, job := range q.jobs {
+		counts[job.State]++
+	}
+	return counts
+}
+
+func (q *ImportQueue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		case id := <-q.queue:
+			q.run(id)
+		}
+	}
+}
+
+// run ジョブを続きから投入する。停止を求められた場合はバッチの区切りで抜け、状態を running のまま残す
+func (q *ImportQueue) run(id string) {
+	q.mu.Lock()
+	job := q.jobs[id]
+	resumed := job.resumed
+	job.State = ImportJobRunning
+	q.record(job)
+	q.mu.Unlock()
+
+	f, err := os.Open(q.csvPath(id))
+	if err != nil {
+		q.finish(job, err)
+		return
+	}
+	records, err := csv.NewReader(f).ReadAll()
+	f.Close()
+	if err != nil {
+		q.finish(job, err)
+		return
+	}
+
+	for start := job.ProcessedRows; start < len(records); start += q.batchSize {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+		end := start + q.batchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		if err := q.importBatch(job, records[start:end], start, resumed); err != nil {
+			q.finish(job, err)
+			return
+		}
+		resumed = false
+	}
+	q.finish(job, nil)
+}
+
+// importBatch 1バッチをシャードごとにまとめて投入し、失敗したシャードの行だけを1行ずつ投入し直してエラーの行を特定する
+// 他のシャードで投入できた行は投入済みとして扱う。MySQLに届かないなど行によらないエラーはジョブ全体のエラーとして返す
+func (q *ImportQueue) importBatch(job *ImportJob, records [][]string, offset int, resumed bool) error {
+	h := importHandlers[job.Kind]
+	ctx, cancel := context.WithTimeout(context.Background(), importBatchTimeout)
+	defer cancel()
+
+	rows := make([]map[string]interface{}, 0, len(records))
+	lines := make([]int, 0, len(records))
+	var rowErrors []ImportRowError
+	for i, record := range records {
+		row, err := h.parse(record)
+		if err != nil {
+			rowErrors = append(rowErrors, ImportRowError{Row: offset + i + 1, Message: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+		lines = append(lines, offset+i+1)
+	}
+
+	// 1つのシャードへの INSERT は1文なので、シャードごとにすべて入るか何も入らないかのどちらかになる
+	groups := map[int][]int{}
+	for i, row := range rows {
+		shard := h.shard(row)
+		groups[shard] = append(groups[shard], i)
+	}
+	groupErrs := make(map[int]error, len(groups))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for shard, indexes := range groups {
+		wg.Add(1)
+		go func(shard int, indexes []int) {
+			defer wg.Done()
+			group := make([]map[string]interface{}, 0, len(indexes))
+			for _, i := range indexes {
+				group = append(group, rows[i])
+			}
+			err := h.insert(ctx, group)
+			mu.Lock()
+			groupErrs[shard] = err
+			mu.Unlock()
+		}(shard, indexes)
+	}
+	wg.Wait()
+
+	ok := make([]bool, len(rows))
+	for shard, indexes := range groups {
+		err := groupErrs[shard]
+		if err == nil {
+			for _, i := range indexes {
+				ok[i] = true
+			}
+			continue
+		}
+		if _, isRowErr := err.(*mysql.MySQLError); !isRowErr {
+			return err
+		}
+		for _, i := range indexes {
+			err := h.insert(ctx, []map[string]interface{}{rows[i]})
+			if me, isRowErr := err.(*mysql.MySQLError); isRowErr && resumed && me.Number == mysqlErrDupEntry {
+				// 再開前に投入済みの行
+				err = nil
+			}
+			switch err.(type) {
+			case nil:
+				ok[i] = true
+			case *mysql.MySQLError:
+				rowErrors = append(rowErrors, ImportRowError{Row: lines[i], Message: err.Error()})
+			default:
+				return err
+			}
+		}
+	}
+	sort.Slice(rowErrors, func(i, j int) bool { return rowErrors[i].Row < rowErrors[j].Row })
+	inserted := []map[string]interface{}{}
+	for i, row := range rows {
+		if ok[i] {
+			inserted = append(inserted, row)
+		}
+	}
+	if len(inserted) > 0 {
+		h.invalidate()
+		metrics.addImportedRows(job.Kind, len(inserted))
+		recordChanges(importChanges(job.Kind, job.Actor, job.RequestID, inserted)...)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.ProcessedRows = offset + len(records)
+	job.InsertedRows += len(inserted)
+	for _, e := range rowErrors {
+		job.addRowError(e)
+	}
+	return q.record(job)
+}
+
+func (q *ImportQueue) finish(job *ImportJob, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.State = ImportJobSucceeded
+	if err != nil {
+		job.State = ImportJobFailed
+		job.Error = err.Error()
+	}
+	q.record(job)
+	os.Remove(q.csvPath(job.ID))
+}
+
+// importHandler ジョブの種類ごとの行の読み取り、投入先のシャード、投入、キャッシュの破棄
+type importHandler struct {
+	parse      func([]string) (map[string]interface{}, error)
+	shard      func(map[string]interface{}) int
+	insert     func(context.Context, []map[string]interface{}) error
+	invalidate func()
+}
+
+var importHandlers = map[string]importHandler{
+	listingKindChair: {
+		parse: parseChairRecord,
+		shard: func(row map[string]interface{}) int {
+			return dbChair.shardIndex(int64(row["id"].(int)))
+		},
+		insert: insertChairs,
+		invalidate: func() {
+			chairCacheManager.Flush()
+			chairDataVersion.bump()
+		},
+	},
+	listingKindEstate: {
+		parse:  parseEstateRecord,
+		shard:  func(map[string]interface{}) int { return 0 },
+		insert: insertEstates,
+		invalidate: func() {
+			estateCacheManager.Flush()
+			estateDataVersion.bump()
+		},
+	},
+}
+
+// Close 実行中のバッチを終えてからワーカーを止める。残りは次の起動時に再開する
+func (q *ImportQueue) Close() {
+	close(q.done)
+	q.wg.Wait()
+	q.journal.Close()
+}
+
+// isAsyncImport ?async=true か Prefer: respond-async が指定されていれば非同期で投入する
+func isAsyncImport(c echo.Context) bool {
+	if async, err := strconv.ParseBool(c.QueryParam("async")); err == nil {
+		return async
+	}
+	return c.Request().Header.Get("Prefer") == "respond-async"
+}
+
+func submitImport(c echo.Context, kind string, f io.Reader) error {
+	body, err := ioutil.ReadAll(f)
+	if err != nil {
+		c.Logger().Errorf("failed to read form file: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	job, err := importQueue.Submit(kind, changeActor(c), requestID(c), body)
+	switch err.(type) {
+	case nil:
+	case errInvalidImport:
+		c.Logger().Infof("import rejected : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	default:
+		if err == errImportQueueFull {
+			c.Logger().Infof("import rejected : %v", err)
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+		c.Logger().Errorf("failed to submit import job : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/api/import/"+job.ID)
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func getImportJob(c echo.Context) error {
+	if importQueue == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	job, ok := importQueue.Job(c.Param("jobId"))
+	if !ok {
+		c.Echo().Logger.Infof("import job %v not found", c.Param("jobId"))
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, job)
+}
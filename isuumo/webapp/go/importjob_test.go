@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeChairTable シャードごとに1文の INSERT がすべて入るか何も入らないかを真似る
+type fakeChairTable struct {
+	mu   sync.Mutex
+	rows map[int]bool
+}
+
+func (f *fakeChairTable) insert(_ context.Context, rows []map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, row := range rows {
+		if id := row["id"].(int); f.rows[id] {
+			return &mysql.MySQLError{Number: mysqlErrDupEntry, Message: fmt.Sprintf("Duplicate entry '%d' for key 'PRIMARY'", id)}
+		}
+	}
+	for _, row := range rows {
+		f.rows[row["id"].(int)] = true
+	}
+	return nil
+}
+
+func (f *fakeChairTable) ids() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := []int{}
+	for id := range f.rows {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func useFakeChairTable(t *testing.T, existing ...int) *fakeChairTable {
+	table := &fakeChairTable{rows: map[int]bool{}}
+	for _, id := range existing {
+		table.rows[id] = true
+	}
+	saved := importHandlers[listingKindChair]
+	importHandlers[listingKindChair] = importHandler{
+		parse:      parseChairRecord,
+		shard:      func(row map[string]interface{}) int { return row["id"].(int) % 2 },
+		insert:     table.insert,
+		invalidate: func() {},
+	}
+	t.Cleanup(func() { importHandlers[listingKindChair] = saved })
+	return table
+}
+
+func chairCSVRecords(ids ...int) [][]string {
+	records := [][]string{}
+	for _, id := range ids {
+		records = append(records, []string{
+			strconv.Itoa(id), "椅子", "", "", "1000", "80", "50", "50", "黒", "", "ゲーミングチェア", "1", "3",
+		})
+	}
+	return records
+}
+
+// createdChairs 購読者に配られた chair.created のIDを返す
+func createdChairs(sub *eventSubscriber) []int {
+	ids := []int{}
+	for {
+		select {
+		case ev := <-sub.ch:
+			if ev.Type == EventChairCreated {
+				ids = append(ids, int(ev.ListingID))
+			}
+		default:
+			sort.Ints(ids)
+			return ids
+		}
+	}
+}
+
+func Test_ImportBatchRetriesOnlyTheFailedShard(t *testing.T) {
+	// ID 4 はすでにあるので、偶数のIDのシャードだけが失敗する
+	table := useFakeChairTable(t, 4)
+	q, err := NewImportQueue(tempDir(t), 0, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	_, _, sub := eventHub.Subscribe("", 0, nil)
+	defer eventHub.Unsubscribe(sub)
+
+	job := &ImportJob{ID: "job", Kind: listingKindChair, State: ImportJobRunning, Errors: []ImportRowError{}}
+	q.jobs[job.ID] = job
+	if err := q.importBatch(job, chairCSVRecords(1, 2, 3, 4, 5, 6), 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if job.InsertedRows != 5 || job.FailedRows != 1 || len(job.Errors) != 1 || job.Errors[0].Row != 4 {
+		t.Errorf("inserted %d, failed %d, errors %+v", job.InsertedRows, job.FailedRows, job.Errors)
+	}
+	if got := table.ids(); !reflect.DeepEqual(got, []int{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("table = %v", got)
+	}
+	// 他のシャードで入った行も投入済みとしてイベントになる
+	if got := createdChairs(sub); !reflect.DeepEqual(got, []int{1, 2, 3, 5, 6}) {
+		t.Errorf("created events = %v", got)
+	}
+}
+
+func Test_ImportResumesAfterRestartWithoutReportingDuplicates(t *testing.T) {
+	// 1から3まで投入した後、ジャーナルに記録する前に止まった
+	table := useFakeChairTable(t, 1, 2, 3)
+	dir := tempDir(t)
+	f, err := os.Create(filepath.Join(dir, "job.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(chairCSVRecords(1, 2, 3, 4, 5, 6, 7))
+	f.Close()
+	b, _ := json.Marshal(ImportJob{ID: "job", Kind: listingKindChair, State: ImportJobRunning, TotalRows: 7, Errors: []ImportRowError{}})
+	if err := ioutil.WriteFile(filepath.Join(dir, "journal.jsonl"), append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewImportQueue(dir, 1, 1, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	var job ImportJob
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		job, _ = q.Job("job")
+		if job.finished() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", job)
+		}
+	}
+	if job.State != ImportJobSucceeded || job.ProcessedRows != 7 || job.InsertedRows != 7 || job.FailedRows != 0 {
+		t.Errorf("job = %+v", job)
+	}
+	if got := table.ids(); !reflect.DeepEqual(got, []int{1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("table = %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "job.csv")); !os.IsNotExist(err) {
+		t.Errorf("the uploaded csv must be removed once the job finishes")
+	}
+}
+
+func Test_ImportReportsDuplicatesOfFreshJobs(t *testing.T) {
+	// 再開ではないジョブの重複は行のエラーとして返す
+	useFakeChairTable(t, 2)
+	q, err := NewImportQueue(tempDir(t), 0, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	job := &ImportJob{ID: "job", Kind: listingKindChair, State: ImportJobRunning, Errors: []ImportRowError{}}
+	q.jobs[job.ID] = job
+	if err := q.importBatch(job, chairCSVRecords(2, 4), 10, false); err != nil {
+		t.Fatal(err)
+	}
+	if job.InsertedRows != 1 || len(job.Errors) != 1 || job.Errors[0].Row != 11 || job.ProcessedRows != 12 {
+		t.Errorf("job = %+v", job)
+	}
+}
+
+func Test_ImportSubmitRecordsTheJobBeforeQueueing(t *testing.T) {
+	useFakeChairTable(t)
+	dir := tempDir(t)
+	q, err := NewImportQueue(dir, 0, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("1,椅子,,,1000,80,50,50,黒,,ゲーミングチェア,1,3\n")
+
+	// ジャーナルに書けなければ受け付けない
+	q.journal.Close()
+	if _, err := q.Submit(listingKindChair, "admin", "req", body); err == nil {
+		t.Fatal("Submit must fail when the journal cannot be written")
+	}
+	if len(q.jobs) != 0 || len(q.queue) != 0 {
+		t.Errorf("jobs = %v, queued = %d", q.jobs, len(q.queue))
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.csv")); len(files) != 0 {
+		t.Errorf("csv files = %v", files)
+	}
+
+	// 受け付けたジョブはワーカーが動く前に止まっても再起動後に残っている
+	q, err = NewImportQueue(dir, 0, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Submit(listingKindChair, "admin", "req", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Submit(listingKindChair, "admin", "req", body); err != errImportQueueFull {
+		t.Errorf("Submit = %v, want %v", err, errImportQueueFull)
+	}
+	q.Close()
+	q, err = NewImportQueue(dir, 0, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if restored, ok := q.Job(job.ID); !ok || restored.State != ImportJobQueued || len(q.queue) != 1 {
+		t.Errorf("restored = %+v, %v, queued = %d", restored, ok, len(q.queue))
+	}
+}
+
+func Test_ImportQueueForgetsFinishedJobsAfterTTL(t *testing.T) {
+	dir := tempDir(t)
+	q, err := NewImportQueue(dir, 0, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.jobs["old"] = &ImportJob{ID: "old", State: ImportJobSucceeded, UpdatedAt: now.Add(-2 * time.Hour)}
+	q.jobs["recent"] = &ImportJob{ID: "recent", State: ImportJobFailed, UpdatedAt: now.Add(-time.Minute)}
+	q.jobs["slow"] = &ImportJob{ID: "slow", State: ImportJobRunning, UpdatedAt: now.Add(-2 * time.Hour)}
+	for _, id := range []string{"old", "recent", "slow"} {
+		q.mu.Lock()
+		err := q.record(q.jobs[id])
+		q.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// record で更新時刻が変わるので戻す
+	q.jobs["old"].UpdatedAt = now.Add(-2 * time.Hour)
+	q.evict(now)
+	if _, ok := q.Job("old"); ok {
+		t.Errorf("a job finished before the ttl must be forgotten")
+	}
+	for _, id := range []string{"recent", "slow"} {
+		if _, ok := q.Job(id); !ok {
+			t.Errorf("job %v must be kept", id)
+		}
+	}
+	q.Close()
+
+	// 書き直したジャーナルからも ttl を過ぎたジョブは読み込まない
+	q, err = NewImportQueue(dir, 0, 1, 10, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if _, ok := q.Job("recent"); ok {
+		t.Errorf("expired jobs must not be restored")
+	}
+	if _, ok := q.Job("slow"); !ok {
+		t.Errorf("unfinished jobs must be resumed regardless of the ttl")
+	}
+}
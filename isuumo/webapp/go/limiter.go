@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// AdaptiveLimiter レイテンシを見ながら同時実行数の上限を増減させる (AIMD)
+// レイテンシの指数移動平均が目標を超えたら上限を減らし、下回っている間は少しずつ増やす
+type AdaptiveLimiter struct {
+	mu            sync.Mutex
+	limit         float64
+	minLimit      float64
+	maxLimit      float64
+	targetLatency time.Duration
+	inflight      int
+	latencyEWMA   time.Duration
+	// decreased 最後に上限を減らした時刻。減らした効果が平均に表れる前に何度も減らさないよう、目標レイテンシの間は減らさない
+	decreased time.Time
+	accepted  int64
+	rejected  int64
+}
+
+type LimiterConfig struct {
+	InitialLimit  float64
+	MinLimit      float64
+	MaxLimit      float64
+	TargetLatency time.Duration
+	RetryAfter    time.Duration
+}
+
+type LimiterStat struct {
+	Group           string  `json:"group"`
+	Limit           int     `json:"limit"`
+	Inflight        int     `json:"inflight"`
+	Accepted        int64   `json:"accepted"`
+	Rejected        int64   `json:"rejected"`
+	LatencyEWMAMs   float64 `json:"latencyEwmaMs"`
+	TargetLatencyMs float64 `json:"targetLatencyMs"`
+}
+
+// latencyEWMAWeight 直近のレイテンシを指数移動平均に反映する重み
+const latencyEWMAWeight = 0.1
+
+// limitDecreaseRatio レイテンシの平均が目標を超えたときに上限に掛ける係数
+const limitDecreaseRatio = 0.9
+
+func NewAdaptiveLimiter(conf LimiterConfig) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		limit:         conf.InitialLimit,
+		minLimit:      conf.MinLimit,
+		maxLimit:      conf.MaxLimit,
+		targetLatency: conf.TargetLatency,
+	}
+}
+
+// acquire 上限に空きがあれば実行中のリクエストとして数える
+func (l *AdaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) {
+		l.rejected++
+		return false
+	}
+	l.inflight++
+	l.accepted++
+	return true
+}
+
+// release リクエストの完了時に呼び、レイテンシの指数移動平均に応じて上限を調整する
+func (l *AdaptiveLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if l.latencyEWMA == 0 {
+		l.latencyEWMA = latency
+	} else {
+		l.latencyEWMA = time.Duration((1-latencyEWMAWeight)*float64(l.latencyEWMA) + latencyEWMAWeight*float64(latency))
+	}
+
+	if l.latencyEWMA > l.targetLatency {
+		if now := time.Now(); now.Sub(l.decreased) >= l.targetLatency {
+			l.limit = math.Max(l.minLimit, l.limit*limitDecreaseRatio)
+			l.decreased = now
+		}
+	} else if float64(l.inflight+1) >= l.limit/2 {
+		// 上限の半分以上使われているときだけ増やし、暇なときに上限が際限なく伸びるのを防ぐ
+		l.limit = math.Min(l.maxLimit, l.limit+1/l.limit)
+	}
+}
+
+func (l *AdaptiveLimiter) stat(group string) LimiterStat {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return LimiterStat{
+		Group:           group,
+		Limit:           int(l.limit),
+		Inflight:        l.inflight,
+		Accepted:        l.accepted,
+		Rejected:        l.rejected,
+		LatencyEWMAMs:   float64(l.latencyEWMA) / float64(time.Millisecond),
+		TargetLatencyMs: float64(l.targetLatency) / float64(time.Millisecond),
+	}
+}
+
+// LoadShedder ルートのグループごとに AdaptiveLimiter を持ち、上限を超えたリクエストを 503 で返す
+type LoadShedder struct {
+	conf     LimiterConfig
+	limiters map[string]*AdaptiveLimiter
+}
+
+var loadShedder *LoadShedder
+
+func NewLoadShedder(conf LimiterConfig, groups []string) *LoadShedder {
+	s := &LoadShedder{conf: conf, limiters: make(map[string]*AdaptiveLimiter, len(groups))}
+	for _, g := range groups {
+		s.limiters[g] = NewAdaptiveLimiter(conf)
+	}
+	return s
+}
+
+// loadSheddingGroup ルートのパスから負荷制御のグループを決める。対象外のルートは空文字を返す
+func loadSheddingGroup(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/chair"):
+		return "chair"
+	case path == "/api/estate/nazotte":
+		return "nazotte"
+	case strings.HasPrefix(path, "/api/estate"):
+		return "estate"
+	case strings.HasPrefix(path, "/api/recommended_estate"):
+		return "recommend"
+	}
+	return ""
+}
+
+func (s *LoadShedder) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l, ok := s.limiters[loadSheddingGroup(c.Path())]
+		if !ok {
+			return next(c)
+		}
+		if !l.acquire() {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.conf.RetryAfter.Seconds()))))
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+		start := time.Now()
+		defer func() {
+			l.release(time.Since(start))
+		}()
+		return next(c)
+	}
+}
+
+func (s *LoadShedder) Stats() []LimiterStat {
+	stats := make([]LimiterStat, 0, len(s.limiters))
+	for g, l := range s.limiters {
+		stats = append(stats, l.stat(g))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Group < stats[j].Group
+	})
+	return stats
+}
+
+func getLoadShedderStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, loadShedder.Stats())
+}
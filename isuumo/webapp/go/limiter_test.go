@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func Test_AdaptiveLimiterRelease(t *testing.T) {
+	// 目標レイテンシを長くして、減らした後の待ち時間がテストの間に過ぎないようにする
+	const target = time.Hour
+	conf := LimiterConfig{InitialLimit: 10, MinLimit: 2, MaxLimit: 20, TargetLatency: target}
+	for _, tc := range []struct {
+		name      string
+		limit     float64
+		inflight  int
+		ewma      time.Duration
+		decreased time.Duration // 直前に減らしてからの時間。0なら減らしたことがない
+		latency   time.Duration
+		want      float64
+	}{
+		{name: "busy and fast", limit: 10, inflight: 6, latency: time.Minute, want: 10.1},
+		{name: "idle and fast", limit: 10, inflight: 1, latency: time.Minute, want: 10},
+		{name: "at max", limit: 20, inflight: 20, latency: time.Minute, want: 20},
+		{name: "slow", limit: 10, inflight: 1, latency: 2 * target, want: 9},
+		{name: "slow on average", limit: 10, inflight: 1, ewma: 2 * target, latency: time.Minute, want: 9},
+		{name: "slow right after a decrease", limit: 10, inflight: 1, latency: 2 * target, decreased: time.Minute, want: 10},
+		{name: "slow a target later", limit: 10, inflight: 1, latency: 2 * target, decreased: target, want: 9},
+		{name: "at min", limit: 2.1, inflight: 1, latency: 2 * target, want: 2},
+	} {
+		l := NewAdaptiveLimiter(conf)
+		l.limit, l.inflight, l.latencyEWMA = tc.limit, tc.inflight, tc.ewma
+		if tc.decreased > 0 {
+			l.decreased = time.Now().Add(-tc.decreased)
+		}
+		l.release(tc.latency)
+		if math.Abs(l.limit-tc.want) > 1e-9 {
+			t.Errorf("%v: limit = %v, want %v", tc.name, l.limit, tc.want)
+		}
+	}
+}
+
+func Test_AdaptiveLimiterDecreasesOncePerTarget(t *testing.T) {
+	l := NewAdaptiveLimiter(LimiterConfig{InitialLimit: 100, MinLimit: 1, MaxLimit: 100, TargetLatency: time.Hour})
+	for i := 0; i < 50; i++ {
+		l.acquire()
+		l.release(2 * time.Hour)
+	}
+	if l.limit != 90 {
+		t.Errorf("limit = %v, want a single decrease to 90", l.limit)
+	}
+}
+
+func Test_LoadShedderRejectsWithRetryAfter(t *testing.T) {
+	s := NewLoadShedder(LimiterConfig{InitialLimit: 1, MinLimit: 1, MaxLimit: 1, TargetLatency: time.Second, RetryAfter: 1500 * time.Millisecond}, []string{"chair"})
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	e := echo.New()
+	e.Use(s.Middleware)
+	e.GET("/api/chair/:id", func(c echo.Context) error {
+		if c.Param("id") == "slow" {
+			close(entered)
+			<-unblock
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/initialize", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/chair/slow", nil))
+	}()
+	<-entered
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/chair/1", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("over the limit = %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	// 対象外のルートは上限に関係なく通す
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/initialize", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("ungrouped route = %d", rec.Code)
+	}
+
+	close(unblock)
+	<-done
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/chair/1", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("after release = %d", rec.Code)
+	}
+	if stats := s.Stats(); stats[0].Accepted != 2 || stats[0].Rejected != 1 || stats[0].Inflight != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"encoding/json"
@@ -23,26 +24,25 @@ import (
 	"github.com/sevenNt/echo-pprof"
 )
 
-const Limit = 20
-const NazotteLimit = 50
-
-var dbEstate *sqlx.DB
-var dbChair *sqlx.DB
+var dbEstate *Cluster
+var dbChair *ShardRouter
 var mySQLEstateConnectionData *MySQLConnectionEnv
-var mySQLChairConnectionData *MySQLConnectionEnv
 var chairSearchCondition ChairSearchCondition
 var estateSearchCondition EstateSearchCondition
 
-var stmtGetChairDetail *sqlx.Stmt
-var stmtGetLowPricedChair *sqlx.Stmt
-var stmtGetEstateDetail *sqlx.Stmt
-var stmtGetLowPricedEstate *sqlx.Stmt
-var stmtSearchRecommendedEstateWithChair1 *sqlx.Stmt
-var stmtSearchRecommendedEstateWithChair2 *sqlx.Stmt
-var stmtPostEstateRequestDocument *sqlx.Stmt
+var stmtGetChairDetail *ShardedStmt
+var stmtGetLowPricedChair *ShardedStmt
+var stmtGetEstateDetail *ClusterStmt
+var stmtGetLowPricedEstate *ClusterStmt
+var stmtSearchRecommendedEstateWithChair1 *ShardedStmt
+var stmtSearchRecommendedEstateWithChair2 *ClusterStmt
+var stmtPostEstateRequestDocument *ClusterStmt
+
+// lowPricedCacheKey 椅子、物件それぞれのキャッシュで安い順の一覧を保持するキー
+const lowPricedCacheKey = "getLowPriced"
 
-var chairCacheManager *gocache.Cache
-var estateCacheManager *gocache.Cache
+var chairCacheManager *CacheManager
+var estateCacheManager *CacheManager
 
 type InitializeResponse struct {
 	Language string `json:"language"`
@@ -90,12 +90,16 @@ type Estate struct {
 	Longitude   float64 `db:"longitude" json:"longitude"`
 	Point 		Point   `db:"point" json:"-"`
 	Address     string  `db:"address" json:"address"`
+	Prefecture  string  `db:"prefecture" json:"prefecture"`
+	City        string  `db:"city" json:"city"`
 	Rent        int64   `db:"rent" json:"rent"`
 	DoorHeight  int64   `db:"door_height" json:"doorHeight"`
 	DoorWidth   int64   `db:"door_width" json:"doorWidth"`
 	Features    string  `db:"features" json:"features"`
 	Popularity  int64   `db:"popularity" json:"-"`
 	PopularityReversed  int64   `db:"popularity_reversed" json:"-"`
+	Status      string  `db:"status" json:"status"`
+	StatusChangedAt *time.Time `db:"status_changed_at" json:"statusChangedAt,omitempty"`
 }
 
 //EstateSearchResponse estate/searchへのレスポンスの形式
@@ -138,6 +142,7 @@ type EstateSearchCondition struct {
 	DoorHeight RangeCondition `json:"doorHeight"`
 	Rent       RangeCondition `json:"rent"`
 	Feature    ListCondition  `json:"feature"`
+	Region     *RegionCondition `json:"region,omitempty"`
 }
 
 type ChairSearchCondition struct {
@@ -158,11 +163,11 @@ type BoundingBox struct {
 }
 
 type MySQLConnectionEnv struct {
-	Host     string
-	Port     string
-	User     string
-	DBName   string
-	Password string
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	DBName   string `json:"dbName"`
+	Password string `json:"password"`
 }
 
 type RecordMapper struct {
@@ -223,26 +228,6 @@ func (r *RecordMapper) Err() error {
 	return r.err
 }
 
-func NewMySQLEstateConnectionEnv() *MySQLConnectionEnv {
-	return &MySQLConnectionEnv{
-		Host:     getEnv("MYSQL_HOST", "172.31.36.65"),
-		Port:     getEnv("MYSQL_PORT", "3306"),
-		User:     getEnv("MYSQL_USER", "isucon"),
-		DBName:   getEnv("MYSQL_DBNAME", "isuumo"),
-		Password: getEnv("MYSQL_PASS", "isucon"),
-	}
-}
-
-func NewMySQLChairConnectionEnv() *MySQLConnectionEnv {
-	return &MySQLConnectionEnv{
-		Host:     getEnv("MYSQL_HOST", "172.31.44.10"),
-		Port:     getEnv("MYSQL_PORT", "3306"),
-		User:     getEnv("MYSQL_USER", "isucon"),
-		DBName:   getEnv("MYSQL_DBNAME", "isuumo"),
-		Password: getEnv("MYSQL_PASS", "isucon"),
-	}
-}
-
 func getEnv(key, defaultValue string) string {
 	val := os.Getenv(key)
 	if val != "" {
@@ -252,28 +237,29 @@ func getEnv(key, defaultValue string) string {
 }
 
 //ConnectDB isuumoデータベースに接続する
-func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
-	return sqlx.Open("mysql", dsn)
+func (mc *MySQLConnectionEnv) ConnectDB(name string) (*DB, error) {
+	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
+	db, err := sqlx.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{conn: db, name: name}, nil
 }
 
-func init() {
-	jsonText, err := ioutil.ReadFile("../fixture/chair_condition.json")
+func loadSearchConditions() {
+	jsonText, err := ioutil.ReadFile(config.Fixture.ChairCondition)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
 	}
 	json.Unmarshal(jsonText, &chairSearchCondition)
 
-	jsonText, err = ioutil.ReadFile("../fixture/estate_condition.json")
+	jsonText, err = ioutil.ReadFile(config.Fixture.EstateCondition)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
 	}
 	json.Unmarshal(jsonText, &estateSearchCondition)
-
-	chairCacheManager = gocache.New(5*time.Minute, 10*time.Minute)
-	estateCacheManager = gocache.New(5*time.Minute, 10*time.Minute)
 }
 
 func main() {
@@ -282,14 +268,72 @@ func main() {
 	e.Debug = true
 	e.Logger.SetLevel(log.DEBUG)
 
+	var err error
+	config, err = LoadConfig()
+	if err != nil {
+		e.Logger.Fatalf("invalid config : %v", err)
+	}
+	loadSearchConditions()
+
+	chairCacheManager = NewCacheManager("chair", time.Duration(config.Cache.TTL), time.Duration(config.Cache.CleanupInterval))
+	estateCacheManager = NewCacheManager("estate", time.Duration(config.Cache.TTL), time.Duration(config.Cache.CleanupInterval))
+
+	botFilter, err = LoadBotFilter(config.BotFilter.RulesFile)
+	if err != nil {
+		e.Logger.Fatalf("failed to load bot rules : %v", err)
+	}
+
+	tracer, err = NewTracer(config.Trace.File)
+	if err != nil {
+		e.Logger.Fatalf("failed to open trace file : %v", err)
+	}
+	if tracer != nil {
+		defer tracer.Close()
+	}
+
+	accessLogger, err = NewAccessLogger(config.AccessLog.File, config.AccessLog.SampleRate)
+	if err != nil {
+		e.Logger.Fatalf("failed to open access log : %v", err)
+	}
+
 	// Middleware
-	// e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(RequestIDMiddleware)
+	e.Use(TracingMiddleware)
+	e.Use(ReadYourWritesMiddleware)
+	if accessLogger != nil {
+		e.Use(accessLogger.Middleware)
+		defer accessLogger.Close()
+	}
+	e.Use(metrics.Middleware)
+	e.Use(botFilter.Middleware)
+
+	adminAuth, err = LoadAdminAuth(config.Admin.KeysFile, config.Admin.AuditLogFile, time.Duration(config.Admin.MaxClockSkew))
+	if err != nil {
+		e.Logger.Fatalf("failed to load admin keys : %v", err)
+	}
+	switch {
+	case adminAuth != nil:
+		e.Use(adminAuth.Middleware)
+		defer adminAuth.Close()
+	case config.Admin.AllowUnauthenticated:
+		e.Logger.Warnf("admin.keysFile is not set and admin.allowUnauthenticated is true : admin routes are served without authentication")
+	default:
+		e.Logger.Warnf("admin.keysFile is not set : admin routes are refused")
+		e.Use(denyAdminRoutes)
+	}
+
+	loadShedder = NewLoadShedder(config.limiterConfig(), []string{"chair", "estate", "nazotte", "recommend"})
+	e.Use(loadShedder.Middleware)
+
+	routeTimeouts = NewRouteTimeouts(time.Duration(config.Timeout.Default), config.Timeout.Routes)
+	e.Use(routeTimeouts.Middleware)
 
 	// Initialize
 	e.POST("/initialize", initialize)
 
 	// Chair Handler
+	e.GET("/api/chair", getChairs)
 	e.GET("/api/chair/:id", getChairDetail)
 	e.POST("/api/chair", postChair)
 	e.GET("/api/chair/search", searchChairs)
@@ -298,70 +342,165 @@ func main() {
 	e.POST("/api/chair/buy/:id", buyChair)
 
 	// Estate Handler
+	e.GET("/api/estate", getEstates)
 	e.GET("/api/estate/:id", getEstateDetail)
 	e.POST("/api/estate", postEstate)
 	e.GET("/api/estate/search", searchEstates)
 	e.GET("/api/estate/low_priced", getLowPricedEstate)
 	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
+	e.POST("/api/estate/status/:id", postEstateStatus)
 	e.POST("/api/estate/nazotte", searchEstateNazotte)
 	e.GET("/api/estate/search/condition", getEstateSearchCondition)
+	e.GET("/api/estate/clusters", getEstateClusters)
+	e.GET("/api/estate/tiles/:z/:x/:y", getEstateTile)
 	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
 
+	e.GET("/api/import/:jobId", getImportJob)
+	e.GET("/api/events", getEvents)
+	e.POST("/api/saved_search", postSavedSearch)
+	e.GET("/api/saved_search/:id", getSavedSearch)
+	e.DELETE("/api/saved_search/:id", deleteSavedSearch)
+
+	// Health Check Handler
+	e.GET("/healthz", getHealthz)
+	e.GET("/readyz", getReadyz)
+
+	// Debug Handler
+	e.GET("/debug/bot", getBotFilterStats)
+	e.GET("/debug/limiter", getLoadShedderStats)
+	e.GET("/debug/replicas", getReplicaStats)
+	e.GET("/metrics", getMetrics)
+	e.GET("/debug/queries", getQueryReport)
+	e.GET("/debug/config", getConfig)
+
+	// Admin Handler
+	e.GET("/admin/audit/changes", getChangeAudit)
+
 	echopprof.Wrap(e)
 
-	mySQLEstateConnectionData = NewMySQLEstateConnectionEnv()
+	mySQLEstateConnectionData = &config.MySQL.Estate
 
-	var err error
-	dbEstate, err = mySQLEstateConnectionData.ConnectDB()
+	dbEstate, err = NewCluster("estate", config.MySQL.Estate, config.MySQL.EstateReplicas, config.MySQL)
 	if err != nil {
 		e.Logger.Fatalf("DB connection failed : %v", err)
 	}
-	dbEstate.SetMaxOpenConns(10)
 	defer dbEstate.Close()
 
-	mySQLChairConnectionData = NewMySQLChairConnectionEnv()
-	dbChair, err = mySQLChairConnectionData.ConnectDB()
+	dbChair, err = NewShardRouter("chair", config.MySQL.chairShardConfigs(), config.MySQL)
 	if err != nil {
 		e.Logger.Fatalf("DB connection failed : %v", err)
 	}
-	dbChair.SetMaxOpenConns(10)
 	defer dbChair.Close()
 
-	stmtGetChairDetail, err = dbChair.Preparex(`SELECT * FROM chair WHERE id = ?`)
+	stmtGetChairDetail, err = dbChair.PreparexContext(context.Background(), `SELECT * FROM chair WHERE id = ?`)
 	if err != nil {
 		e.Logger.Fatalf("Prepared statment error: %v", err)
 	}
-	stmtGetLowPricedChair, err = dbChair.Preparex(`SELECT * FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?`)
+	stmtGetLowPricedChair, err = dbChair.PreparexContext(context.Background(), `SELECT * FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?`)
 	if err != nil {
 		e.Logger.Fatalf("Prepared statment error: %v", err)
 	}
-	stmtGetEstateDetail, err = dbEstate.Preparex(`SELECT * FROM estate WHERE id = ?`)
+	stmtGetEstateDetail, err = dbEstate.PreparexContext(context.Background(), `SELECT * FROM estate WHERE id = ?`)
 	if err != nil {
 		e.Logger.Fatalf("Prepared statment error: %v", err)
 	}
-	stmtGetLowPricedEstate, err = dbEstate.Preparex(`SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?`)
+	stmtGetLowPricedEstate, err = dbEstate.PreparexContext(context.Background(), `SELECT * FROM estate WHERE status = 'available' ORDER BY rent ASC, id ASC LIMIT ?`)
 	if err != nil {
 		e.Logger.Fatalf("Prepared statment error: %v", err)
 	}
-	stmtSearchRecommendedEstateWithChair1, err = dbChair.Preparex(`SELECT * FROM chair WHERE id = ?`)
+	stmtSearchRecommendedEstateWithChair1, err = dbChair.PreparexContext(context.Background(), `SELECT * FROM chair WHERE id = ?`)
 	if err != nil {
 		e.Logger.Fatalf("Prepared statment error: %v", err)
 	}
-	stmtSearchRecommendedEstateWithChair2, err = dbEstate.Preparex(`SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity_reversed, id ASC LIMIT ?`)
+	stmtSearchRecommendedEstateWithChair2, err = dbEstate.PreparexContext(context.Background(), `SELECT * FROM estate WHERE status = 'available' AND ((door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?)) ORDER BY popularity_reversed, id ASC LIMIT ?`)
 	if err != nil {
 		e.Logger.Fatalf("Prepared statment error: %v", err)
 	}
-	stmtPostEstateRequestDocument, err = dbEstate.Preparex(`SELECT * FROM estate WHERE id = ?`)
+	stmtPostEstateRequestDocument, err = dbEstate.PreparexContext(context.Background(), `SELECT * FROM estate WHERE id = ?`)
 	if err != nil {
 		e.Logger.Fatalf("Prepared statment error: %v", err)
 	}
 
+	defer closeStatements()
+
+	stockLedger, err = NewStockLedger(config.StockLedger.JournalFile, time.Duration(config.StockLedger.FlushInterval), config.StockLedger.BatchSize)
+	if err != nil {
+		e.Logger.Fatalf("failed to start stock ledger : %v", err)
+	}
+	if stockLedger != nil {
+		defer stockLedger.Close()
+	}
+
+	eventHub = NewEventHub(config.Events.BufferSize)
+
+	changeAudit, err = NewChangeAudit(config.ChangeAudit.File, int64(config.ChangeAudit.MaxFileBytes), config.ChangeAudit.MaxFiles)
+	if err != nil {
+		e.Logger.Fatalf("failed to open change audit : %v", err)
+	}
+	if changeAudit != nil {
+		defer changeAudit.Close()
+	}
+
+	if config.SavedSearch.File != "" {
+		ss := config.SavedSearch
+		webhooks := NewWebhookDispatcher(newWebhookClient(time.Duration(ss.Timeout), ss.AllowedHosts), ss.Workers, ss.QueueSize, ss.MaxAttempts, time.Duration(ss.InitialBackoff), time.Duration(ss.MaxBackoff))
+		defer webhooks.Close()
+		savedSearches, err = NewSavedSearches(ss, webhooks)
+		if err != nil {
+			e.Logger.Fatalf("failed to load saved searches : %v", err)
+		}
+		defer savedSearches.Close()
+	}
+
+	importQueue, err = NewImportQueue(config.Import.Dir, config.Import.Workers, config.Import.QueueSize, config.Import.BatchSize, time.Duration(config.Import.JobTTL))
+	if err != nil {
+		e.Logger.Fatalf("failed to start import queue : %v", err)
+	}
+	if importQueue != nil {
+		defer importQueue.Close()
+	}
+
+	if err := warmUp(context.Background()); err != nil {
+		e.Logger.Errorf("warm up failed : %v", err)
+	}
+
 	// Start server
-	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
-	e.Logger.Fatal(e.Start(serverPort))
+	serverPort := fmt.Sprintf(":%v", config.Server.Port)
+	startServer(e, serverPort, time.Duration(config.Server.ShutdownTimeout))
+}
+
+func closeStatements() {
+	for _, stmt := range []*ShardedStmt{
+		stmtGetChairDetail,
+		stmtGetLowPricedChair,
+		stmtSearchRecommendedEstateWithChair1,
+	} {
+		stmt.Close()
+	}
+	for _, stmt := range []*ClusterStmt{
+		stmtGetEstateDetail,
+		stmtGetLowPricedEstate,
+		stmtSearchRecommendedEstateWithChair2,
+		stmtPostEstateRequestDocument,
+	} {
+		stmt.Close()
+	}
 }
 
 func initialize(c echo.Context) error {
+	readiness.beginInitialize()
+	defer readiness.endInitialize()
+	if stockLedger != nil {
+		// 入れ直している間の購入は断り、入れ直した後の在庫から数え直す
+		stockLedger.Suspend()
+		defer stockLedger.Resume()
+	}
+	for _, kind := range []string{listingKindChair, listingKindEstate} {
+		recordChanges(ChangeAuditEntry{RequestID: requestID(c), Actor: changeActor(c), Action: ChangeReset, Kind: kind})
+	}
+	// mysql コマンドでプライマリに投入したデータをレプリカの遅延に関係なく読めるようにする
+	markWritten(c.Request().Context(), append([]*Cluster{dbEstate}, dbChair.shards...)...)
+
 	sqlDir := filepath.Join("..", "mysql", "db")
 	pathsEstate := []string{
 		filepath.Join(sqlDir, "0_Schema.sql"),
@@ -379,34 +518,65 @@ func initialize(c echo.Context) error {
 			mySQLEstateConnectionData.DBName,
 			sqlFile,
 		)
-		if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
+		if err := exec.CommandContext(c.Request().Context(), "bash", "-c", cmdStr).Run(); err != nil {
 			c.Logger().Errorf("Initialize script error : %v", err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
 
+	if err := fillEstateRegions(c.Request().Context(), dbEstate); err != nil {
+		c.Logger().Errorf("Initialize estate region error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	pathsChair := []string{
 		filepath.Join(sqlDir, "0_Schema.sql"),
 		filepath.Join(sqlDir, "1_DummyEstateData.sql"),
 		filepath.Join(sqlDir, "2_DummyChairData.sql"),
 	}
 
-	for _, p := range pathsChair {
-		sqlFile, _ := filepath.Abs(p)
-		cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
-			mySQLChairConnectionData.Host,
-			mySQLChairConnectionData.User,
-			mySQLChairConnectionData.Password,
-			mySQLChairConnectionData.Port,
-			mySQLChairConnectionData.DBName,
-			sqlFile,
-		)
-		if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
-			c.Logger().Errorf("Initialize script error : %v", err)
+	// 各シャードに全件を投入してから、そのシャードに属さない椅子を消す
+	for i, mySQLChairConnectionData := range dbChair.envs {
+		for _, p := range pathsChair {
+			sqlFile, _ := filepath.Abs(p)
+			cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
+				mySQLChairConnectionData.Host,
+				mySQLChairConnectionData.User,
+				mySQLChairConnectionData.Password,
+				mySQLChairConnectionData.Port,
+				mySQLChairConnectionData.DBName,
+				sqlFile,
+			)
+			if err := exec.CommandContext(c.Request().Context(), "bash", "-c", cmdStr).Run(); err != nil {
+				c.Logger().Errorf("Initialize script error : %v", err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+		if len(dbChair.shards) > 1 {
+			_, err := dbChair.shards[i].ExecContext(c.Request().Context(), "DELETE FROM chair WHERE MOD(id, ?) != ?", len(dbChair.shards), i)
+			if err != nil {
+				c.Logger().Errorf("Initialize chair shard error : %v", err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	if stockLedger != nil {
+		if err := stockLedger.Reset(); err != nil {
+			c.Logger().Errorf("Initialize stock ledger error : %v", err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
 
+	chairDataVersion.bump()
+	estateDataVersion.bump()
+	queryStats.reset()
+
+	if err := warmUp(c.Request().Context()); err != nil {
+		c.Logger().Errorf("Initialize warm up error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
 	})
@@ -419,9 +589,13 @@ func getChairDetail(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	if notModified(c, chairDataVersion, "chair-"+strconv.Itoa(id)) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	chair := Chair{}
 	// query := `SELECT * FROM chair WHERE id = ?`
-	err = stmtGetChairDetail.Get(&chair, id)
+	err = stmtGetChairDetail.on(int64(id)).GetContext(c.Request().Context(), &chair, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("requested id's chair not found : %v", id)
@@ -429,12 +603,12 @@ func getChairDetail(c echo.Context) error {
 		}
 		c.Echo().Logger.Errorf("Failed to get the chair from id : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
-	} else if chair.Stock <= 0 {
+	} else if currentStock(chair) <= 0 {
 		c.Echo().Logger.Infof("requested id's chair is sold out : %v", id)
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	return c.JSON(http.StatusOK, chair)
+	return fragmentResponse(c, chair.fragment)
 }
 
 func postChair(c echo.Context) error {
@@ -449,58 +623,88 @@ func postChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer f.Close()
+	if importQueue != nil && isAsyncImport(c) {
+		return submitImport(c, listingKindChair, f)
+	}
 	records, err := csv.NewReader(f).ReadAll()
 	if err != nil {
 		c.Logger().Errorf("failed to read csv: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	chairs := make([]map[string]interface{}, 500)
-	for i, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		price := rm.NextInt()
-		height := rm.NextInt()
-		width := rm.NextInt()
-		depth := rm.NextInt()
-		color := rm.NextString()
-		features := rm.NextString()
-		kind := rm.NextString()
-		popularity := rm.NextInt()
-		stock := rm.NextInt()
-		if err := rm.Err(); err != nil {
+	chairs := make([]map[string]interface{}, 0, len(records))
+	for _, row := range records {
+		chair, err := parseChairRecord(row)
+		if err != nil {
 			c.Logger().Errorf("failed to read record: %v", err)
 			return c.NoContent(http.StatusBadRequest)
 		}
-		chairs[i] = map[string]interface{}{
-			"id":          id,
-			"name":        name,
-			"description": description,
-			"thumbnail":   thumbnail,
-			"price":       price,
-			"height":      height,
-			"width":       width,
-			"depth":       depth,
-			"color":       color,
-			"features":    features,
-			"kind":        kind,
-			"popularity":  popularity,
-			"stock":       stock,
-		}
+		chairs = append(chairs, chair)
 	}
 	chairCacheManager.Flush()
-	_, err = dbChair.NamedExec(`INSERT INTO chair (id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES (:id,:name,:description,:thumbnail,:price,:height,:width,:depth,:color,:features,:kind,:popularity,:stock)`, chairs)
-	if err != nil {
-			c.Logger().Errorf("failed to insert chair: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+	if err := insertChairs(c.Request().Context(), chairs); err != nil {
+		c.Logger().Errorf("failed to insert chair: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
+	chairDataVersion.bump()
+	metrics.addImportedRows("chair", len(records))
+	recordChanges(importChanges(listingKindChair, changeActor(c), requestID(c), chairs)...)
 
 	return c.NoContent(http.StatusCreated)
 }
 
+// parseChairRecord CSVの1行を INSERT INTO chair の名前付きパラメータにする
+func parseChairRecord(row []string) (map[string]interface{}, error) {
+	rm := RecordMapper{Record: row}
+	id := rm.NextInt()
+	name := rm.NextString()
+	description := rm.NextString()
+	thumbnail := rm.NextString()
+	price := rm.NextInt()
+	height := rm.NextInt()
+	width := rm.NextInt()
+	depth := rm.NextInt()
+	color := rm.NextString()
+	features := rm.NextString()
+	kind := rm.NextString()
+	popularity := rm.NextInt()
+	stock := rm.NextInt()
+	if err := rm.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"id":          id,
+		"name":        name,
+		"description": description,
+		"thumbnail":   thumbnail,
+		"price":       price,
+		"height":      height,
+		"width":       width,
+		"depth":       depth,
+		"color":       color,
+		"features":    features,
+		"kind":        kind,
+		"popularity":  popularity,
+		"stock":       stock,
+	}, nil
+}
+
+// insertChairs 椅子のIDでシャードに振り分けて、シャードごとにまとめて投入する
+func insertChairs(ctx context.Context, rows []map[string]interface{}) error {
+	chairs := make([][]map[string]interface{}, len(dbChair.shards))
+	for _, row := range rows {
+		shard := dbChair.shardIndex(int64(row["id"].(int)))
+		chairs[shard] = append(chairs[shard], row)
+	}
+	return dbChair.scatter(ctx, func(ctx context.Context, i int, shard *Cluster) error {
+		if len(chairs[i]) == 0 {
+			return nil
+		}
+		_, err := shard.NamedExecContext(ctx, `INSERT INTO chair (id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES (:id,:name,:description,:thumbnail,:price,:height,:width,:depth,:color,:features,:kind,:popularity,:stock)`, chairs[i])
+		return err
+	})
+}
+
 func searchChairs(c echo.Context) error {
 	conditions := make([]string, 0)
 	params := make([]interface{}, 0)
@@ -596,6 +800,13 @@ func searchChairs(c echo.Context) error {
 	}
 
 	conditions = append(conditions, "stock > 0")
+	// 在庫台帳で売り切れた椅子は、MySQLに書き出すまでは stock > 0 のまま残っている
+	if stockLedger != nil {
+		if soldOut := stockLedger.SoldOut(); len(soldOut) > 0 {
+			conditions = append(conditions, "id NOT IN (?)")
+			params = append(params, soldOut)
+		}
+	}
 
 	page, err := strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
@@ -611,30 +822,48 @@ func searchChairs(c echo.Context) error {
 
 	searchQuery := "SELECT * FROM chair WHERE "
 	countQuery := "SELECT COUNT(*) FROM chair WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity_reversed, id ASC LIMIT ? OFFSET ?"
-
-	var res ChairSearchResponse
-	err = dbChair.Get(&res.Count, countQuery+searchCondition, params...)
+	searchCondition, params, err := sqlx.In(strings.Join(conditions, " AND "), params...)
 	if err != nil {
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
+		c.Logger().Errorf("searchChairs query build error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	chairs := []Chair{}
-	params = append(params, perPage, page*perPage)
-	err = dbChair.Select(&chairs, searchQuery+searchCondition+limitOffset, params...)
-	if err != nil {
+	// 全体での OFFSET 以降を求めるため、各シャードからは先頭から OFFSET + LIMIT 件を取り出して合わせる
+	// シャードが1つなら深いページでも余分に読まないよう、そのまま OFFSET を渡す
+	limitOffset := " ORDER BY popularity_reversed, id ASC LIMIT ?"
+	shardParams := append(params, perPage+page*perPage)
+	mergeOffset := page * perPage
+	if len(dbChair.shards) == 1 {
+		limitOffset = " ORDER BY popularity_reversed, id ASC LIMIT ? OFFSET ?"
+		shardParams = append(params, perPage, page*perPage)
+		mergeOffset = 0
+	}
+
+	counts := make([]int64, len(dbChair.shards))
+	lists := make([][]Chair, len(dbChair.shards))
+	err = dbChair.scatter(c.Request().Context(), func(ctx context.Context, i int, shard *Cluster) error {
+		if err := shard.GetContext(ctx, &counts[i], countQuery+searchCondition, params...); err != nil {
+			return err
+		}
+		err := shard.SelectContext(ctx, &lists[i], searchQuery+searchCondition+limitOffset, shardParams...)
 		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
+			return nil
 		}
+		return err
+	})
+	if err != nil {
 		c.Logger().Errorf("searchChairs DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	res.Chairs = chairs
+	var res ChairSearchResponse
+	for _, n := range counts {
+		res.Count += n
+	}
+	res.Chairs = mergeChairs(lists, chairPopularityOrder, mergeOffset, perPage)
 
-	return c.JSON(http.StatusOK, res)
+	return fragmentResponse(c, func() ([]byte, error) {
+		return chairListJSON(true, res.Count, res.Chairs)
+	})
 }
 
 func buyChair(c echo.Context) error {
@@ -644,7 +873,7 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, ok := m["email"].(string)
+	email, ok := m["email"].(string)
 	if !ok {
 		c.Echo().Logger.Info("post buy chair failed : email not found in request body")
 		return c.NoContent(http.StatusBadRequest)
@@ -656,7 +885,33 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	tx, err := dbChair.Beginx()
+	if stockLedger != nil {
+		remaining, bought, err := stockLedger.Buy(c.Request().Context(), int64(id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+				return c.NoContent(http.StatusNotFound)
+			}
+			if err == errStockLedgerSuspended {
+				c.Echo().Logger.Infof("buyChair chair id \"%v\" during initialize", id)
+				return c.NoContent(http.StatusServiceUnavailable)
+			}
+			c.Echo().Logger.Errorf("buyChair stock ledger error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if !bought {
+			c.Echo().Logger.Infof("buyChair chair id \"%v\" is sold out", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		if remaining <= 0 {
+			chairCacheManager.Flush()
+		}
+		chairDataVersion.bump()
+		recordPurchase(c, email, int64(id), remaining+1)
+		return c.NoContent(http.StatusOK)
+	}
+
+	tx, err := dbChair.shard(int64(id)).BeginTxx(c.Request().Context(), nil)
 	if err != nil {
 		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -664,7 +919,7 @@ func buyChair(c echo.Context) error {
 	defer tx.Rollback()
 
 	var chair Chair
-	err = tx.QueryRowx("SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
+	err = tx.QueryRowxContext(c.Request().Context(), "SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
@@ -674,7 +929,7 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, err = tx.Exec("UPDATE chair SET stock = stock - 1 WHERE id = ?", id)
+	_, err = tx.ExecContext(c.Request().Context(), "UPDATE chair SET stock = stock - 1 WHERE id = ?", id)
 	if err != nil {
 		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -685,27 +940,55 @@ func buyChair(c echo.Context) error {
 		c.Echo().Logger.Errorf("transaction commit error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	// 最後の1つが売れたら、安い順の一覧に残らないようにする
+	if chair.Stock <= 1 {
+		chairCacheManager.Flush()
+	}
+	chairDataVersion.bump()
+	recordPurchase(c, email, int64(id), chair.Stock)
 
 	return c.NoContent(http.StatusOK)
 }
 
+// recordPurchase 購入者のメールアドレスを操作した人として在庫の減少を記録する
+func recordPurchase(c echo.Context, email string, id, before int64) {
+	recordChanges(ChangeAuditEntry{
+		RequestID: requestID(c),
+		Actor:     changeAudit.userActor(email),
+		Action:    ChangePurchase,
+		Kind:      listingKindChair,
+		ListingID: id,
+		Before:    map[string]interface{}{"stock": before},
+		After:     map[string]interface{}{"stock": before - 1},
+	})
+}
+
 func getChairSearchCondition(c echo.Context) error {
+	if notModified(c, chairDataVersion, "chair-condition") {
+		return c.NoContent(http.StatusNotModified)
+	}
 	return c.JSON(http.StatusOK, chairSearchCondition)
 }
 
 func getLowPricedChair(c echo.Context) error {
 	var chairs []Chair
-	var cacheKey = "getLowPriced"
+	var cacheKey = lowPricedCacheKey
+
+	if notModified(c, chairDataVersion, "chair-low-priced") {
+		return c.NoContent(http.StatusNotModified)
+	}
 
-	v, found := chairCacheManager.Get(cacheKey)
+	v, found := chairCacheManager.GetContext(c.Request().Context(), cacheKey)
 	if found {
 		gotChairs := v.([]Chair)
-		return c.JSON(http.StatusOK, ChairListResponse{Chairs: gotChairs})
+		return fragmentResponse(c, func() ([]byte, error) {
+			return chairListJSON(false, 0, gotChairs)
+		})
 	}
 
 	// query := `SELECT * FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?`
 	// err := dbChair.Select(&chairs, query, Limit)
-	err := stmtGetLowPricedChair.Select(&chairs, Limit)
+	chairs, err := lowPricedChairs(c.Request().Context())
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Logger().Error("getLowPricedChair not found")
@@ -716,7 +999,9 @@ func getLowPricedChair(c echo.Context) error {
 	}
 
 	chairCacheManager.Set(cacheKey, chairs, gocache.DefaultExpiration)
-	return c.JSON(http.StatusOK, ChairListResponse{Chairs: chairs})
+	return fragmentResponse(c, func() ([]byte, error) {
+		return chairListJSON(false, 0, chairs)
+	})
 }
 
 func getEstateDetail(c echo.Context) error {
@@ -726,9 +1011,18 @@ func getEstateDetail(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	etagKey := "estate-" + strconv.Itoa(id)
+	if acceptsGeoJSON(c) {
+		etagKey += "-geo"
+	}
+	c.Response().Header().Set("Vary", echo.HeaderAccept)
+	if notModified(c, estateDataVersion, etagKey) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	var estate Estate
 	// err = dbEstate.Get(&estate, "SELECT * FROM estate WHERE id = ?", id)
-	err = stmtGetEstateDetail.Get(&estate, id)
+	err = stmtGetEstateDetail.GetContext(c.Request().Context(), &estate, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("getEstateDetail estate id %v not found", id)
@@ -738,7 +1032,10 @@ func getEstateDetail(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, estate)
+	if acceptsGeoJSON(c) {
+		return geoJSON(c, http.StatusOK, estate.toGeoJSONFeature(estate.geoJSONProperties()))
+	}
+	return fragmentResponse(c, estate.fragment)
 }
 
 func getRange(cond RangeCondition, rangeID string) (*Range, error) {
@@ -766,56 +1063,79 @@ func postEstate(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer f.Close()
+	if importQueue != nil && isAsyncImport(c) {
+		return submitImport(c, listingKindEstate, f)
+	}
 	records, err := csv.NewReader(f).ReadAll()
 	if err != nil {
 		c.Logger().Errorf("failed to read csv: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	estates := make([]map[string]interface{}, 500)
-	for i, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		address := rm.NextString()
-		latitude := rm.NextFloat()
-		longitude := rm.NextFloat()
-		rent := rm.NextInt()
-		doorHeight := rm.NextInt()
-		doorWidth := rm.NextInt()
-		features := rm.NextString()
-		popularity := rm.NextInt()
-		if err := rm.Err(); err != nil {
+	estates := make([]map[string]interface{}, 0, len(records))
+	for _, row := range records {
+		estate, err := parseEstateRecord(row)
+		if err != nil {
 			c.Logger().Errorf("failed to read record: %v", err)
 			return c.NoContent(http.StatusBadRequest)
 		}
-		estates[i] = map[string]interface{}{
-			"id":          id,
-			"name":        name,
-			"description": description,
-			"thumbnail":   thumbnail,
-			"address":     address,
-			"latitude":    latitude,
-			"longitude":   longitude,
-			"rent":        rent,
-			"door_height": doorHeight,
-			"door_width":  doorWidth,
-			"features":    features,
-			"popularity":  popularity,
-		}
+		estates = append(estates, estate)
 	}
 	estateCacheManager.Flush()
-	_, err = dbEstate.NamedExec("INSERT INTO estate (id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity) VALUES (:id, :name, :description, :thumbnail, :address, :latitude, :longitude, :rent, :door_height, :door_width, :features, :popularity)", estates)
-	if err != nil {
+	if err := insertEstates(c.Request().Context(), estates); err != nil {
 		c.Logger().Errorf("failed to insert estate: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	estateDataVersion.bump()
+	metrics.addImportedRows("estate", len(records))
+	recordChanges(importChanges(listingKindEstate, changeActor(c), requestID(c), estates)...)
 	return c.NoContent(http.StatusCreated)
 }
 
-func searchEstates(c echo.Context) error {
+// parseEstateRecord CSVの1行を INSERT INTO estate の名前付きパラメータにする。都道府県と市区町村は住所から補う
+func parseEstateRecord(row []string) (map[string]interface{}, error) {
+	rm := RecordMapper{Record: row}
+	id := rm.NextInt()
+	name := rm.NextString()
+	description := rm.NextString()
+	thumbnail := rm.NextString()
+	address := rm.NextString()
+	latitude := rm.NextFloat()
+	longitude := rm.NextFloat()
+	rent := rm.NextInt()
+	doorHeight := rm.NextInt()
+	doorWidth := rm.NextInt()
+	features := rm.NextString()
+	popularity := rm.NextInt()
+	if err := rm.Err(); err != nil {
+		return nil, err
+	}
+	prefecture, city := parseAddress(address)
+	return map[string]interface{}{
+		"id":          id,
+		"name":        name,
+		"description": description,
+		"thumbnail":   thumbnail,
+		"address":     address,
+		"prefecture":  prefecture,
+		"city":        city,
+		"latitude":    latitude,
+		"longitude":   longitude,
+		"rent":        rent,
+		"door_height": doorHeight,
+		"door_width":  doorWidth,
+		"features":    features,
+		"popularity":  popularity,
+	}, nil
+}
+
+func insertEstates(ctx context.Context, rows []map[string]interface{}) error {
+	_, err := dbEstate.NamedExecContext(ctx, "INSERT INTO estate (id, name, description, thumbnail, address, prefecture, city, latitude, longitude, rent, door_height, door_width, features, popularity) VALUES (:id, :name, :description, :thumbnail, :address, :prefecture, :city, :latitude, :longitude, :rent, :door_height, :door_width, :features, :popularity)", rows)
+	return err
+}
+
+// estateSearchConditions 物件検索のクエリパラメータからWHERE句の条件とそのパラメータを組み立てる
+func estateSearchConditions(c echo.Context) ([]string, []interface{}, error) {
 	conditions := make([]string, 0)
 	params := make([]interface{}, 0)
 
@@ -823,7 +1143,7 @@ func searchEstates(c echo.Context) error {
 		doorHeight, err := getRange(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			return nil, nil, err
 		}
 
 		if doorHeight.Min != -1 {
@@ -840,7 +1160,7 @@ func searchEstates(c echo.Context) error {
 		doorWidth, err := getRange(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			return nil, nil, err
 		}
 
 		if doorWidth.Min != -1 {
@@ -857,7 +1177,7 @@ func searchEstates(c echo.Context) error {
 		estateRent, err := getRange(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
 		if err != nil {
 			c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			return nil, nil, err
 		}
 
 		if estateRent.Min != -1 {
@@ -877,11 +1197,33 @@ func searchEstates(c echo.Context) error {
 		}
 	}
 
+	if c.QueryParam("prefecture") != "" {
+		conditions = append(conditions, "prefecture = ?")
+		params = append(params, c.QueryParam("prefecture"))
+	}
+
+	if c.QueryParam("city") != "" {
+		conditions = append(conditions, "city = ?")
+		params = append(params, c.QueryParam("city"))
+	}
+
+	return conditions, params, nil
+}
+
+func searchEstates(c echo.Context) error {
+	conditions, params, err := estateSearchConditions(c)
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
 	if len(conditions) == 0 {
 		c.Echo().Logger.Infof("searchEstates search condition not found")
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	conditions = append(conditions, "status = ?")
+	params = append(params, EstateStatusAvailable)
+
 	page, err := strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
 		c.Logger().Infof("Invalid format page parameter : %v", err)
@@ -900,7 +1242,7 @@ func searchEstates(c echo.Context) error {
 	limitOffset := " ORDER BY popularity_reversed, id ASC LIMIT ? OFFSET ?"
 
 	var res EstateSearchResponse
-	err = dbEstate.Get(&res.Count, countQuery+searchCondition, params...)
+	err = dbEstate.GetContext(c.Request().Context(), &res.Count, countQuery+searchCondition, params...)
 	if err != nil {
 		c.Logger().Errorf("searchEstates DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -908,7 +1250,7 @@ func searchEstates(c echo.Context) error {
 
 	estates := []Estate{}
 	params = append(params, perPage, page*perPage)
-	err = dbEstate.Select(&estates, searchQuery+searchCondition+limitOffset, params...)
+	err = dbEstate.SelectContext(c.Request().Context(), &estates, searchQuery+searchCondition+limitOffset, params...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
@@ -919,22 +1261,28 @@ func searchEstates(c echo.Context) error {
 
 	res.Estates = estates
 
-	return c.JSON(http.StatusOK, res)
+	return estateSearchResult(c, res)
 }
 
 func getLowPricedEstate(c echo.Context) error {
-	estates := make([]Estate, 0, Limit)
-	var cacheKey = "getLowPriced"
+	estates := make([]Estate, 0, config.Search.Limit)
+	var cacheKey = lowPricedCacheKey
+
+	if notModified(c, estateDataVersion, "estate-low-priced") {
+		return c.NoContent(http.StatusNotModified)
+	}
 
-	v, found := estateCacheManager.Get(cacheKey)
+	v, found := estateCacheManager.GetContext(c.Request().Context(), cacheKey)
 	if found {
 		gotEstates := v.([]Estate)
-		return c.JSON(http.StatusOK, EstateListResponse{Estates: gotEstates})
+		return fragmentResponse(c, func() ([]byte, error) {
+			return estateListJSON(false, 0, gotEstates)
+		})
 	}
 
-	// query := `SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
+	// query := `SELECT * FROM estate WHERE status = 'available' ORDER BY rent ASC, id ASC LIMIT ?`
 	// err := dbEstate.Select(&estates, query, Limit)
-	err := stmtGetLowPricedEstate.Select(&estates, Limit)
+	err := stmtGetLowPricedEstate.SelectContext(c.Request().Context(), &estates, config.Search.Limit)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Logger().Error("getLowPricedEstate not found")
@@ -945,7 +1293,9 @@ func getLowPricedEstate(c echo.Context) error {
 	}
 
 	estateCacheManager.Set(cacheKey, estates, gocache.DefaultExpiration)
-	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	return fragmentResponse(c, func() ([]byte, error) {
+		return estateListJSON(false, 0, estates)
+	})
 }
 
 func searchRecommendedEstateWithChair(c echo.Context) error {
@@ -958,7 +1308,7 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 	chair := Chair{}
 	// query := `SELECT * FROM chair WHERE id = ?`
 	// err = dbChair.Get(&chair, query, id)
-	err = stmtSearchRecommendedEstateWithChair1.Get(&chair, id)
+	err = stmtSearchRecommendedEstateWithChair1.on(int64(id)).GetContext(c.Request().Context(), &chair, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Logger().Infof("Requested chair id \"%v\" not found", id)
@@ -972,9 +1322,9 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 	w := chair.Width
 	h := chair.Height
 	d := chair.Depth
-	// query = `SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity_reversed, id ASC LIMIT ?`
+	// query = `SELECT * FROM estate WHERE status = 'available' AND ((door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?)) ORDER BY popularity_reversed, id ASC LIMIT ?`
 	// err = dbEstate.Select(&estates, query, w, h, w, d, h, w, h, d, d, w, d, h, Limit)
-	err = stmtSearchRecommendedEstateWithChair2.Select(&estates, w, h, w, d, h, w, h, d, d, w, d, h, Limit)
+	err = stmtSearchRecommendedEstateWithChair2.SelectContext(c.Request().Context(), &estates, w, h, w, d, h, w, h, d, d, w, d, h, config.Search.Limit)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
@@ -983,24 +1333,27 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	return fragmentResponse(c, func() ([]byte, error) {
+		return estateListJSON(false, 0, estates)
+	})
 }
 
 func searchEstateNazotte(c echo.Context) error {
-	coordinates := Coordinates{}
-	err := c.Bind(&coordinates)
+	body, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
 		c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	if len(coordinates.Coordinates) == 0 {
+	polygon, err := parseNazotteRequest(body)
+	if err != nil {
+		c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
 	estatesInPolygon := []Estate{}
-	query := fmt.Sprintf(`SELECT * FROM estate WHERE ST_Contains(ST_PolygonFromText(%s), point) ORDER BY popularity_reversed`, coordinates.coordinatesToText())
-	err = dbEstate.Select(&estatesInPolygon, query)
+	query := `SELECT * FROM estate WHERE ST_Contains(ST_GeomFromText(?), point) AND status = 'available' ORDER BY popularity_reversed`
+	err = dbEstate.SelectContext(c.Request().Context(), &estatesInPolygon, query, polygon.toText())
 	if err != nil {
 		if err == sql.ErrNoRows {
 			;
@@ -1012,14 +1365,14 @@ func searchEstateNazotte(c echo.Context) error {
 
 	var re EstateSearchResponse
 	re.Estates = []Estate{}
-	if len(estatesInPolygon) > NazotteLimit {
-		re.Estates = estatesInPolygon[:NazotteLimit]
+	if len(estatesInPolygon) > config.Search.NazotteLimit {
+		re.Estates = estatesInPolygon[:config.Search.NazotteLimit]
 	} else {
 		re.Estates = estatesInPolygon
 	}
 	re.Count = int64(len(re.Estates))
 
-	return c.JSON(http.StatusOK, re)
+	return estateSearchResult(c, re)
 }
 
 func postEstateRequestDocument(c echo.Context) error {
@@ -1044,7 +1397,7 @@ func postEstateRequestDocument(c echo.Context) error {
 	estate := Estate{}
 	// query := `SELECT * FROM estate WHERE id = ?`
 	// err = dbEstate.Get(&estate, query, id)
-	err = stmtPostEstateRequestDocument.Get(&estate, id)
+	err = stmtPostEstateRequestDocument.GetContext(c.Request().Context(), &estate, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.NoContent(http.StatusNotFound)
@@ -1057,7 +1410,19 @@ func postEstateRequestDocument(c echo.Context) error {
 }
 
 func getEstateSearchCondition(c echo.Context) error {
-	return c.JSON(http.StatusOK, estateSearchCondition)
+	if notModified(c, estateDataVersion, "estate-condition") {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	region, err := getRegionCondition(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("getEstateSearchCondition DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	cond := estateSearchCondition
+	cond.Region = &region
+	return c.JSON(http.StatusOK, cond)
 }
 
 func (cs Coordinates) getBoundingBox() BoundingBox {
@@ -1087,11 +1452,3 @@ func (cs Coordinates) getBoundingBox() BoundingBox {
 	}
 	return boundingBox
 }
-
-func (cs Coordinates) coordinatesToText() string {
-	points := make([]string, 0, len(cs.Coordinates))
-	for _, c := range cs.Coordinates {
-		points = append(points, fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
-	}
-	return fmt.Sprintf("'POLYGON((%s))'", strings.Join(points, ","))
-}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// latencyBuckets リクエストのレイテンシのヒストグラムの境界(秒)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+type latencyKey struct {
+	route  string
+	method string
+}
+
+// cancelKey route にはリクエストならルート、クエリならDB名が入る
+type cancelKey struct {
+	route  string
+	reason string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics Prometheus のテキスト形式で公開するメトリクスを集める
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[latencyKey]*histogram
+
+	requestCancels map[cancelKey]uint64
+	queryCancels   map[cancelKey]uint64
+
+	importedRows sync.Map // kind -> *int64
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  map[requestKey]uint64{},
+		latencies: map[latencyKey]*histogram{},
+
+		requestCancels: map[cancelKey]uint64{},
+		queryCancels:   map[cancelKey]uint64{},
+	}
+}
+
+func (m *Metrics) observeRequest(route, method string, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route: route, method: method, status: status}]++
+	lk := latencyKey{route: route, method: method}
+	h, ok := m.latencies[lk]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[lk] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+// addRequestCancellation クライアントの切断や締め切りで打ち切られたリクエストを数える
+func (m *Metrics) addRequestCancellation(route, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requestCancels[cancelKey{route: route, reason: reason}]++
+}
+
+// addQueryCancellation context が打ち切られて中断したクエリを数える
+func (m *Metrics) addQueryCancellation(db, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queryCancels[cancelKey{route: db, reason: reason}]++
+}
+
+// addImportedRows CSVから投入した行数を数える
+func (m *Metrics) addImportedRows(kind string, n int) {
+	v, _ := m.importedRows.LoadOrStore(kind, new(int64))
+	atomic.AddInt64(v.(*int64), int64(n))
+}
+
+func (m *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		} else if err != nil {
+			status = http.StatusInternalServerError
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unknown"
+		}
+		m.observeRequest(route, c.Request().Method, status, time.Since(start))
+		return err
+	}
+}
+
+// CacheManager 椅子、物件のキャッシュのヒット、ミスを数える
+type CacheManager struct {
+	*gocache.Cache
+	name   string
+	hits   int64
+	misses int64
+}
+
+func NewCacheManager(name string, defaultExpiration, cleanupInterval time.Duration) *CacheManager {
+	return &CacheManager{Cache: gocache.New(defaultExpiration, cleanupInterval), name: name}
+}
+
+func (cm *CacheManager) Get(k string) (interface{}, bool) {
+	v, found := cm.Cache.Get(k)
+	if found {
+		atomic.AddInt64(&cm.hits, 1)
+	} else {
+		atomic.AddInt64(&cm.misses, 1)
+	}
+	return v, found
+}
+
+// GetContext キャッシュの参照をトレースのスパンとして記録する
+func (cm *CacheManager) GetContext(ctx context.Context, k string) (interface{}, bool) {
+	_, span := startSpan(ctx, "cache.get", SpanKindInternal)
+	span.SetAttribute("cache.name", cm.name)
+	span.SetAttribute("cache.key", k)
+	v, found := cm.Get(k)
+	span.SetAttribute("cache.hit", found)
+	span.Finish()
+	return v, found
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m *Metrics) writeHTTP(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	writeHeader(buf, "isuumo_http_requests_total", "counter", "Number of HTTP requests by route, method and status.")
+	for _, k := range requestKeys {
+		fmt.Fprintf(buf, "isuumo_http_requests_total{route=\"%s\",method=\"%s\",status=\"%d\"} %d\n", escapeLabel(k.route), k.method, k.status, m.requests[k])
+	}
+
+	latencyKeys := make([]latencyKey, 0, len(m.latencies))
+	for k := range m.latencies {
+		latencyKeys = append(latencyKeys, k)
+	}
+	sort.Slice(latencyKeys, func(i, j int) bool {
+		a, b := latencyKeys[i], latencyKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.method < b.method
+	})
+	writeHeader(buf, "isuumo_http_request_duration_seconds", "histogram", "HTTP request latency by route and method.")
+	for _, k := range latencyKeys {
+		h := m.latencies[k]
+		labels := fmt.Sprintf("route=\"%s\",method=\"%s\"", escapeLabel(k.route), k.method)
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(buf, "isuumo_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(buf, "isuumo_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(buf, "isuumo_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(buf, "isuumo_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+}
+
+func writeDBStats(buf *bytes.Buffer, dbs map[string]*DB) {
+	names := make([]string, 0, len(dbs))
+	for name, db := range dbs {
+		if db != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(s sql.DBStats) string
+	}{
+		{"isuumo_db_open_connections", "Number of established connections.", func(s sql.DBStats) string { return strconv.Itoa(s.OpenConnections) }},
+		{"isuumo_db_in_use_connections", "Number of connections currently in use.", func(s sql.DBStats) string { return strconv.Itoa(s.InUse) }},
+		{"isuumo_db_idle_connections", "Number of idle connections.", func(s sql.DBStats) string { return strconv.Itoa(s.Idle) }},
+		{"isuumo_db_max_open_connections", "Maximum number of open connections.", func(s sql.DBStats) string { return strconv.Itoa(s.MaxOpenConnections) }},
+	}
+	counters := []struct {
+		name  string
+		help  string
+		value func(s sql.DBStats) string
+	}{
+		{"isuumo_db_wait_count_total", "Number of connections waited for.", func(s sql.DBStats) string { return strconv.FormatInt(s.WaitCount, 10) }},
+		{"isuumo_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", func(s sql.DBStats) string { return formatFloat(s.WaitDuration.Seconds()) }},
+		{"isuumo_db_max_idle_closed_total", "Number of connections closed due to SetMaxIdleConns.", func(s sql.DBStats) string { return strconv.FormatInt(s.MaxIdleClosed, 10) }},
+		{"isuumo_db_max_lifetime_closed_total", "Number of connections closed due to SetConnMaxLifetime.", func(s sql.DBStats) string { return strconv.FormatInt(s.MaxLifetimeClosed, 10) }},
+	}
+
+	stats := make(map[string]sql.DBStats, len(names))
+	for _, name := range names {
+		stats[name] = dbs[name].Stats()
+	}
+	for _, g := range gauges {
+		writeHeader(buf, g.name, "gauge", g.help)
+		for _, name := range names {
+			fmt.Fprintf(buf, "%s{db=\"%s\"} %s\n", g.name, name, g.value(stats[name]))
+		}
+	}
+	for _, c := range counters {
+		writeHeader(buf, c.name, "counter", c.help)
+		for _, name := range names {
+			fmt.Fprintf(buf, "%s{db=\"%s\"} %s\n", c.name, name, c.value(stats[name]))
+		}
+	}
+}
+
+func writeReplicaStats(buf *bytes.Buffer, stats []ReplicaStat) {
+	writeHeader(buf, "isuumo_db_replica_healthy", "gauge", "Whether the replica receives reads (1) or is bypassed (0).")
+	for _, s := range stats {
+		healthy := 0
+		if s.Healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(buf, "isuumo_db_replica_healthy{db=\"%s\"} %d\n", s.Name, healthy)
+	}
+	writeHeader(buf, "isuumo_db_replica_lag_seconds", "gauge", "Last observed replication lag.")
+	for _, s := range stats {
+		fmt.Fprintf(buf, "isuumo_db_replica_lag_seconds{db=\"%s\"} %s\n", s.Name, formatFloat(s.LagMs/1000))
+	}
+}
+
+func writeCacheStats(buf *bytes.Buffer, caches map[string]*CacheManager) {
+	names := make([]string, 0, len(caches))
+	for name := range caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeHeader(buf, "isuumo_cache_requests_total", "counter", "Number of cache lookups by cache and result.")
+	for _, name := range names {
+		cm := caches[name]
+		fmt.Fprintf(buf, "isuumo_cache_requests_total{cache=\"%s\",result=\"hit\"} %d\n", name, atomic.LoadInt64(&cm.hits))
+		fmt.Fprintf(buf, "isuumo_cache_requests_total{cache=\"%s\",result=\"miss\"} %d\n", name, atomic.LoadInt64(&cm.misses))
+	}
+	writeHeader(buf, "isuumo_cache_items", "gauge", "Number of items in the cache.")
+	for _, name := range names {
+		fmt.Fprintf(buf, "isuumo_cache_items{cache=\"%s\"} %d\n", name, caches[name].ItemCount())
+	}
+}
+
+func (m *Metrics) writeImports(buf *bytes.Buffer) {
+	kinds := []string{}
+	m.importedRows.Range(func(k, _ interface{}) bool {
+		kinds = append(kinds, k.(string))
+		return true
+	})
+	sort.Strings(kinds)
+
+	writeHeader(buf, "isuumo_import_rows_total", "counter", "Number of rows imported from CSV uploads.")
+	for _, kind := range kinds {
+		v, _ := m.importedRows.Load(kind)
+		fmt.Fprintf(buf, "isuumo_import_rows_total{kind=\"%s\"} %d\n", kind, atomic.LoadInt64(v.(*int64)))
+	}
+}
+
+func sortedCancelKeys(m map[cancelKey]uint64) []cancelKey {
+	keys := make([]cancelKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	return keys
+}
+
+func (m *Metrics) writeCancellations(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(buf, "isuumo_http_request_cancellations_total", "counter", "Number of requests cut off by client disconnect or deadline by route and reason.")
+	for _, k := range sortedCancelKeys(m.requestCancels) {
+		fmt.Fprintf(buf, "isuumo_http_request_cancellations_total{route=\"%s\",reason=\"%s\"} %d\n", escapeLabel(k.route), k.reason, m.requestCancels[k])
+	}
+	writeHeader(buf, "isuumo_db_query_cancellations_total", "counter", "Number of queries aborted by context cancellation by db and reason.")
+	for _, k := range sortedCancelKeys(m.queryCancels) {
+		fmt.Fprintf(buf, "isuumo_db_query_cancellations_total{db=\"%s\",reason=\"%s\"} %d\n", k.route, k.reason, m.queryCancels[k])
+	}
+}
+
+func writeBotFilterMetrics(buf *bytes.Buffer, f *BotFilter) {
+	if f == nil {
+		return
+	}
+	writeHeader(buf, "isuumo_bot_blocked_total", "counter", "Number of requests blocked as bots by rule.")
+	for _, s := range f.Stats() {
+		fmt.Fprintf(buf, "isuumo_bot_blocked_total{rule=\"%s\"} %d\n", escapeLabel(s.Pattern), s.Blocked)
+	}
+}
+
+func writeLimiterMetrics(buf *bytes.Buffer, shedder *LoadShedder) {
+	if shedder == nil {
+		return
+	}
+	stats := shedder.Stats()
+	writeHeader(buf, "isuumo_limiter_limit", "gauge", "Current concurrency limit by route group.")
+	for _, s := range stats {
+		fmt.Fprintf(buf, "isuumo_limiter_limit{group=\"%s\"} %d\n", s.Group, s.Limit)
+	}
+	writeHeader(buf, "isuumo_limiter_inflight", "gauge", "Number of in-flight requests by route group.")
+	for _, s := range stats {
+		fmt.Fprintf(buf, "isuumo_limiter_inflight{group=\"%s\"} %d\n", s.Group, s.Inflight)
+	}
+	writeHeader(buf, "isuumo_limiter_rejected_total", "counter", "Number of requests rejected by the limiter by route group.")
+	for _, s := range stats {
+		fmt.Fprintf(buf, "isuumo_limiter_rejected_total{group=\"%s\"} %d\n", s.Group, s.Rejected)
+	}
+}
+
+func writeStockLedgerMetrics(buf *bytes.Buffer, l *StockLedger) {
+	if l == nil {
+		return
+	}
+	writeHeader(buf, "isuumo_stock_ledger_pending_units", "gauge", "Number of chair purchases not yet flushed to MySQL.")
+	fmt.Fprintf(buf, "isuumo_stock_ledger_pending_units %d\n", l.pendingUnits())
+	writeHeader(buf, "isuumo_stock_ledger_flushes_total", "counter", "Number of stock flushes by result.")
+	errors := atomic.LoadInt64(&l.flushErrors)
+	fmt.Fprintf(buf, "isuumo_stock_ledger_flushes_total{result=\"ok\"} %d\n", atomic.LoadInt64(&l.flushes)-errors)
+	fmt.Fprintf(buf, "isuumo_stock_ledger_flushes_total{result=\"error\"} %d\n", errors)
+	writeHeader(buf, "isuumo_stock_ledger_flushed_units_total", "counter", "Number of chair purchases flushed to MySQL.")
+	fmt.Fprintf(buf, "isuumo_stock_ledger_flushed_units_total %d\n", atomic.LoadInt64(&l.flushedUnits))
+}
+
+func writeFragmentMetrics(buf *bytes.Buffer, stores map[string]*FragmentStore) {
+	kinds := make([]string, 0, len(stores))
+	for kind := range stores {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	writeHeader(buf, "isuumo_json_fragments", "gauge", "Number of pre-encoded JSON fragments by kind.")
+	for _, kind := range kinds {
+		fmt.Fprintf(buf, "isuumo_json_fragments{kind=\"%s\"} %d\n", kind, stores[kind].Len())
+	}
+	writeHeader(buf, "isuumo_json_fragment_lookups_total", "counter", "Number of JSON fragment lookups by kind and result.")
+	for _, kind := range kinds {
+		store := stores[kind]
+		fmt.Fprintf(buf, "isuumo_json_fragment_lookups_total{kind=\"%s\",result=\"hit\"} %d\n", kind, atomic.LoadInt64(&store.hits))
+		fmt.Fprintf(buf, "isuumo_json_fragment_lookups_total{kind=\"%s\",result=\"miss\"} %d\n", kind, atomic.LoadInt64(&store.misses))
+	}
+}
+
+func writeCompressionMetrics(buf *bytes.Buffer, compressed map[string]*int64) {
+	names := make([]string, 0, len(compressed))
+	for name := range compressed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeHeader(buf, "isuumo_compressed_responses_total", "counter", "Number of compressed responses by content encoding.")
+	for _, name := range names {
+		fmt.Fprintf(buf, "isuumo_compressed_responses_total{encoding=\"%s\"} %d\n", name, atomic.LoadInt64(compressed[name]))
+	}
+}
+
+func writeImportQueueMetrics(buf *bytes.Buffer, q *ImportQueue) {
+	if q == nil {
+		return
+	}
+	counts := q.StateCounts()
+	writeHeader(buf, "isuumo_import_jobs", "gauge", "Number of asynchronous import jobs by state.")
+	for _, state := range []string{ImportJobQueued, ImportJobRunning, ImportJobSucceeded, ImportJobFailed} {
+		fmt.Fprintf(buf, "isuumo_import_jobs{state=\"%s\"} %d\n", state, counts[state])
+	}
+}
+
+func writeAdminAuthMetrics(buf *bytes.Buffer, a *AdminAuth) {
+	if a == nil {
+		return
+	}
+	results := a.Results()
+	writeHeader(buf, "isuumo_admin_auth_total", "counter", "Number of admin route authentications by result.")
+	for _, result := range []string{"ok", "rejected"} {
+		fmt.Fprintf(buf, "isuumo_admin_auth_total{result=\"%s\"} %d\n", result, results[result])
+	}
+}
+
+func writeEventMetrics(buf *bytes.Buffer, h *EventHub) {
+	published, dropped := h.stats()
+	writeHeader(buf, "isuumo_events_subscribers", "gauge", "Number of connected /api/events streams.")
+	fmt.Fprintf(buf, "isuumo_events_subscribers %d\n", h.Subscribers())
+	writeHeader(buf, "isuumo_events_published_total", "counter", "Number of listing events published.")
+	fmt.Fprintf(buf, "isuumo_events_published_total %d\n", published)
+	writeHeader(buf, "isuumo_events_dropped_subscribers_total", "counter", "Number of event streams disconnected because they fell behind.")
+	fmt.Fprintf(buf, "isuumo_events_dropped_subscribers_total %d\n", dropped)
+}
+
+func writeSavedSearchMetrics(buf *bytes.Buffer, s *SavedSearches) {
+	if s == nil {
+		return
+	}
+	writeHeader(buf, "isuumo_saved_searches", "gauge", "Number of saved searches with a callback URL.")
+	fmt.Fprintf(buf, "isuumo_saved_searches %d\n", s.Len())
+	results := s.dispatcher.Results()
+	writeHeader(buf, "isuumo_webhook_deliveries_total", "counter", "Number of saved search notification attempts by result.")
+	for _, result := range []string{WebhookDelivered, WebhookRetried, WebhookFailed, WebhookDropped} {
+		fmt.Fprintf(buf, "isuumo_webhook_deliveries_total{result=\"%s\"} %d\n", result, results[result])
+	}
+}
+
+func getMetrics(c echo.Context) error {
+	var buf bytes.Buffer
+	metrics.writeHTTP(&buf)
+	dbs := map[string]*DB{}
+	replicas := []ReplicaStat{}
+	if dbChair != nil {
+		for name, db := range dbChair.nodes() {
+			dbs[name] = db
+		}
+		replicas = append(replicas, dbChair.ReplicaStats()...)
+	}
+	if dbEstate != nil {
+		for name, db := range dbEstate.nodes() {
+			dbs[name] = db
+		}
+		replicas = append(replicas, dbEstate.ReplicaStats()...)
+	}
+	writeDBStats(&buf, dbs)
+	writeReplicaStats(&buf, replicas)
+	writeCacheStats(&buf, map[string]*CacheManager{"chair": chairCacheManager, "estate": estateCacheManager})
+	metrics.writeImports(&buf)
+	metrics.writeCancellations(&buf)
+	writeBotFilterMetrics(&buf, botFilter)
+	writeLimiterMetrics(&buf, loadShedder)
+	writeStockLedgerMetrics(&buf, stockLedger)
+	writeFragmentMetrics(&buf, map[string]*FragmentStore{"chair": chairFragments, "estate": estateFragments})
+	writeCompressionMetrics(&buf, compressedResponses)
+	writeImportQueueMetrics(&buf, importQueue)
+	writeAdminAuthMetrics(&buf, adminAuth)
+	writeEventMetrics(&buf, eventHub)
+	writeSavedSearchMetrics(&buf, savedSearches)
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// queryLatencySamples p99 の計算のためにクエリごとに保持する直近のレイテンシの数
+const queryLatencySamples = 1024
+
+// DefaultQueryReportLimit /debug/queries で返すクエリ数のデフォルト
+const DefaultQueryReportLimit = 20
+
+var (
+	fingerprintStringRegexp  = regexp.MustCompile(`'(?:[^'\\]|\\.)*'`)
+	fingerprintNumberRegexp  = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	fingerprintInListRegexp  = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintValuesRegexp  = regexp.MustCompile(`(?i)\bVALUES\s*(\([^()]*\))(?:\s*,\s*\([^()]*\))*`)
+	fingerprintSpacingRegexp = regexp.MustCompile(`\s+`)
+)
+
+// fingerprintCache クエリはプレースホルダを使っているため種類が限られるので、正規化の結果を覚えておく
+// sqlx.In で展開した IN や複数行の VALUES は要素数ごとに別のクエリになるので、要素数をまとめたものをキーにする
+var fingerprintCache sync.Map
+
+// fingerprint リテラルやINの要素数の違いを無視してクエリをまとめるための文字列を返す
+func fingerprint(query string) string {
+	key := fingerprintCacheKey(query)
+	if fp, ok := fingerprintCache.Load(key); ok {
+		return fp.(string)
+	}
+	fp := normalizeQuery(query)
+	fingerprintCache.Store(key, fp)
+	return fp
+}
+
+// fingerprintCacheKey プレースホルダが並ぶクエリだけ、IN と VALUES の要素数を1つにまとめる
+func fingerprintCacheKey(query string) string {
+	if !strings.Contains(query, "?,") && !strings.Contains(query, "(?)") {
+		return query
+	}
+	key := fingerprintInListRegexp.ReplaceAllString(query, "IN (?+)")
+	return fingerprintValuesRegexp.ReplaceAllString(key, "VALUES $1")
+}
+
+func normalizeQuery(query string) string {
+	q := fingerprintStringRegexp.ReplaceAllString(query, "?")
+	q = fingerprintNumberRegexp.ReplaceAllString(q, "?")
+	q = fingerprintInListRegexp.ReplaceAllString(q, "IN (?+)")
+	q = fingerprintValuesRegexp.ReplaceAllString(q, "VALUES $1")
+	q = fingerprintSpacingRegexp.ReplaceAllString(q, " ")
+	return strings.TrimSpace(q)
+}
+
+type queryStat struct {
+	count   int64
+	errors  int64
+	rows    int64
+	total   time.Duration
+	samples []time.Duration
+	next    int
+}
+
+func (s *queryStat) p99() time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(s.samples))
+	copy(sorted, s.samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted[(len(sorted)*99+99)/100-1]
+}
+
+// QueryStats フィンガープリントごとのクエリの統計。/initialize でリセットする
+type QueryStats struct {
+	mu    sync.Mutex
+	stats map[string]*queryStat
+	since time.Time
+}
+
+type QueryReport struct {
+	Query   string  `json:"query"`
+	Count   int64   `json:"count"`
+	Errors  int64   `json:"errors"`
+	Rows    int64   `json:"rows"`
+	TotalMs float64 `json:"totalMs"`
+	AvgMs   float64 `json:"avgMs"`
+	P99Ms   float64 `json:"p99Ms"`
+}
+
+type QueryReportResponse struct {
+	Since   time.Time     `json:"since"`
+	Queries []QueryReport `json:"queries"`
+}
+
+var queryStats = NewQueryStats()
+
+func NewQueryStats() *QueryStats {
+	return &QueryStats{stats: map[string]*queryStat{}, since: time.Now()}
+}
+
+func (qs *QueryStats) record(query string, latency time.Duration, rows int64, err error) {
+	fp := fingerprint(query)
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	s, ok := qs.stats[fp]
+	if !ok {
+		s = &queryStat{samples: make([]time.Duration, 0, queryLatencySamples)}
+		qs.stats[fp] = s
+	}
+	s.count++
+	if err != nil && err != sql.ErrNoRows {
+		s.errors++
+	}
+	s.rows += rows
+	s.total += latency
+	if len(s.samples) < queryLatencySamples {
+		s.samples = append(s.samples, latency)
+	} else {
+		s.samples[s.next] = latency
+		s.next = (s.next + 1) % queryLatencySamples
+	}
+}
+
+func (qs *QueryStats) reset() {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.stats = map[string]*queryStat{}
+	qs.since = time.Now()
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// report 合計時間の長い順に n 件のクエリの統計を返す
+func (qs *QueryStats) report(n int) QueryReportResponse {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	reports := make([]QueryReport, 0, len(qs.stats))
+	for q, s := range qs.stats {
+		reports = append(reports, QueryReport{
+			Query:   q,
+			Count:   s.count,
+			Errors:  s.errors,
+			Rows:    s.rows,
+			TotalMs: toMs(s.total),
+			AvgMs:   toMs(s.total) / float64(s.count),
+			P99Ms:   toMs(s.p99()),
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].TotalMs > reports[j].TotalMs
+	})
+	if len(reports) > n {
+		reports = reports[:n]
+	}
+	return QueryReportResponse{Since: qs.since, Queries: reports}
+}
+
+func getQueryReport(c echo.Context) error {
+	n := DefaultQueryReportLimit
+	if c.QueryParam("n") != "" {
+		v, err := strconv.Atoi(c.QueryParam("n"))
+		if err != nil || v <= 0 {
+			c.Echo().Logger.Infof("Request parameter \"n\" invalid : %v", c.QueryParam("n"))
+			return c.NoContent(http.StatusBadRequest)
+		}
+		n = v
+	}
+	return c.JSON(http.StatusOK, queryStats.report(n))
+}
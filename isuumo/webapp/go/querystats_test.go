@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_FingerprintCacheIgnoresListLengths(t *testing.T) {
+	for n := 1; n <= 50; n++ {
+		in := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+		if fp := fingerprint("SELECT * FROM fp_chair WHERE id IN (" + in + ") AND stock > 0"); fp != "SELECT * FROM fp_chair WHERE id IN (?+) AND stock > ?" {
+			t.Fatalf("fingerprint = %q", fp)
+		}
+		values := strings.TrimSuffix(strings.Repeat("(?, ?), ", n), ", ")
+		if fp := fingerprint("INSERT INTO fp_chair (id, name) VALUES " + values); fp != "INSERT INTO fp_chair (id, name) VALUES (?, ?)" {
+			t.Fatalf("fingerprint = %q", fp)
+		}
+	}
+	fingerprint("SELECT * FROM fp_chair WHERE id = ? LIMIT ?, ?")
+
+	keys := 0
+	fingerprintCache.Range(func(key, _ interface{}) bool {
+		if strings.Contains(key.(string), "fp_chair") {
+			keys++
+		}
+		return true
+	})
+	if keys != 3 {
+		t.Errorf("cache holds %d queries, want one per query shape", keys)
+	}
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// 通知に付けるヘッダ。署名は timestamp と "." とボディをつないだものの HMAC-SHA256
+const (
+	webhookDeliveryHeader  = "X-Isuumo-Delivery"
+	webhookTimestampHeader = "X-Isuumo-Timestamp"
+	webhookSignatureHeader = "X-Isuumo-Signature"
+)
+
+// 通知の結果
+const (
+	WebhookDelivered = "delivered"
+	WebhookRetried   = "retried"
+	WebhookFailed    = "failed"
+	WebhookDropped   = "dropped"
+)
+
+// SavedSearch 保存した検索条件。新しく投入された椅子や物件が条件に合うと callbackUrl に通知する
+type SavedSearch struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Query       string          `json:"query,omitempty"`
+	Nazotte     json.RawMessage `json:"nazotte,omitempty"`
+	CallbackURL string          `json:"callbackUrl"`
+	Secret      string          `json:"secret,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	// Client 作成したクライアントのIPアドレスのハッシュ。数の上限に使う
+	Client string `json:"client,omitempty"`
+	// Deleted ファイルに追記する削除の印
+	Deleted bool `json:"deleted,omitempty"`
+
+	chairOK  func(Chair) bool
+	estateOK func(Estate) bool
+	polygon  MultiPolygon
+	bounds   BoundingBox
+}
+
+// compile query を /api/*/search と、nazotte を /api/estate/nazotte と同じ形式として読み、判定する関数を作る
+func (s *SavedSearch) compile() error {
+	q, err := url.ParseQuery(s.Query)
+	if err != nil {
+		return fmt.Errorf("invalid query: %v", err)
+	}
+	switch s.Kind {
+	case listingKindChair:
+		if len(s.Nazotte) > 0 {
+			return fmt.Errorf("nazotte is only for estate")
+		}
+		s.chairOK, err = chairMatcher(q)
+	case listingKindEstate:
+		s.estateOK, err = estateMatcher(q)
+		if err == nil && len(s.Nazotte) > 0 {
+			s.polygon, err = parseNazotteRequest(s.Nazotte)
+			if err == nil {
+				s.bounds = s.polygon.bounds()
+			}
+		}
+	default:
+		return fmt.Errorf("invalid kind %q", s.Kind)
+	}
+	return err
+}
+
+// match 検索と同じく在庫のない椅子と販売中でない物件は含めない
+func (s *SavedSearch) match(ev ListingEvent) bool {
+	switch {
+	case s.chairOK != nil && ev.chair != nil:
+		return ev.chair.Stock > 0 && s.chairOK(*ev.chair)
+	case s.estateOK != nil && ev.estate != nil:
+		if ev.estate.Status != EstateStatusAvailable || !s.estateOK(*ev.estate) {
+			return false
+		}
+		if s.polygon == nil {
+			return true
+		}
+		c := Coordinate{Latitude: ev.estate.Latitude, Longitude: ev.estate.Longitude}
+		return s.bounds.contains(c) && s.polygon.contains(c)
+	}
+	return false
+}
+
+// contains MySQL の ST_Contains と同じく緯度経度を平面の座標として、いずれかのポリゴンの内側にあるかを判定する
+func (mp MultiPolygon) contains(c Coordinate) bool {
+	for _, polygon := range mp {
+		if len(polygon) == 0 || !ringContains(polygon[0], c) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, c) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// bounds 外周のリングを囲む矩形。多角形の内外を判定する前に外側のものを除く
+func (mp MultiPolygon) bounds() BoundingBox {
+	b := BoundingBox{}
+	first := true
+	for _, polygon := range mp {
+		if len(polygon) == 0 {
+			continue
+		}
+		for _, c := range polygon[0] {
+			if first {
+				b.TopLeftCorner, b.BottomRightCorner, first = c, c, false
+				continue
+			}
+			b.TopLeftCorner.Latitude = math.Min(b.TopLeftCorner.Latitude, c.Latitude)
+			b.TopLeftCorner.Longitude = math.Min(b.TopLeftCorner.Longitude, c.Longitude)
+			b.BottomRightCorner.Latitude = math.Max(b.BottomRightCorner.Latitude, c.Latitude)
+			b.BottomRightCorner.Longitude = math.Max(b.BottomRightCorner.Longitude, c.Longitude)
+		}
+	}
+	return b
+}
+
+func (b BoundingBox) contains(c Coordinate) bool {
+	return b.TopLeftCorner.Latitude <= c.Latitude && c.Latitude <= b.BottomRightCorner.Latitude &&
+		b.TopLeftCorner.Longitude <= c.Longitude && c.Longitude <= b.BottomRightCorner.Longitude
+}
+
+// ringContains 点から伸ばした半直線と辺が交わる回数で内外を判定する
+func ringContains(ring []Coordinate, c Coordinate) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Longitude > c.Longitude) != (b.Longitude > c.Longitude) &&
+			c.Latitude < (b.Latitude-a.Latitude)*(c.Longitude-a.Longitude)/(b.Longitude-a.Longitude)+a.Latitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// WebhookNotification 1回の投入で1件の保存した検索条件に合った椅子や物件をまとめて通知する
+type WebhookNotification struct {
+	DeliveryID string            `json:"deliveryId"`
+	SearchID   string            `json:"searchId"`
+	Kind       string            `json:"kind"`
+	Listings   []json.RawMessage `json:"listings"`
+	Time       time.Time         `json:"time"`
+}
+
+type webhookDelivery struct {
+	id       string
+	url      string
+	secret   []byte
+	body     []byte
+	attempts int
+}
+
+// WebhookDispatcher 通知を送り、失敗したものは間隔を倍にしながら maxAttempts 回まで送り直す
+// 送り直しを待っている通知はメモリ上にしか持たないため、再起動すると失われる
+type WebhookDispatcher struct {
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan *webhookDelivery
+	timers map[*time.Timer]struct{}
+	wg     sync.WaitGroup
+
+	results sync.Map // string -> *int64
+}
+
+func NewWebhookDispatcher(client *http.Client, workers, queueSize, maxAttempts int, initialBackoff, maxBackoff time.Duration) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		client:         client,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		queue:          make(chan *webhookDelivery, queueSize),
+		timers:         map[*time.Timer]struct{}{},
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// Send キューが一杯か停止中なら送らずに捨てる
+func (d *WebhookDispatcher) Send(id, callbackURL string, secret []byte, body []byte) bool {
+	return d.enqueue(&webhookDelivery{id: id, url: callbackURL, secret: secret, body: body})
+}
+
+func (d *WebhookDispatcher) enqueue(delivery *webhookDelivery) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		d.count(WebhookDropped)
+		return false
+	}
+	select {
+	case d.queue <- delivery:
+		return true
+	default:
+		d.count(WebhookDropped)
+		return false
+	}
+}
+
+func (d *WebhookDispatcher) worker() {
+	defer d.wg.Done()
+	for delivery := range d.queue {
+		delivery.attempts++
+		retry, err := d.post(delivery)
+		switch {
+		case err == nil:
+			d.count(WebhookDelivered)
+		case retry && delivery.attempts < d.maxAttempts:
+			d.count(WebhookRetried)
+			d.retryLater(delivery)
+		default:
+			d.count(WebhookFailed)
+		}
+	}
+}
+
+// post 通知を1回送る。送り直すと成功する見込みがあるかも返す
+func (d *WebhookDispatcher) post(delivery *webhookDelivery) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	req.Header.Set(webhookDeliveryHeader, delivery.id)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(signWebhook(delivery.secret, timestamp, delivery.body)))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	// 受け取り側の一時的な問題でなければ送り直しても結果は変わらない
+	retry = res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("callback responded %v", res.Status)
+}
+
+// retryLater initialBackoff から失敗するごとに倍にし、maxBackoff を上限として最大2割の揺らぎを足して待つ
+func (d *WebhookDispatcher) retryLater(delivery *webhookDelivery) {
+	wait := d.initialBackoff
+	for i := 1; i < delivery.attempts && wait < d.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.maxBackoff {
+		wait = d.maxBackoff
+	}
+	wait += time.Duration(rand.Int63n(int64(wait)/5 + 1))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		d.count(WebhookDropped)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		delete(d.timers, t)
+		d.mu.Unlock()
+		d.enqueue(delivery)
+	})
+	d.timers[t] = struct{}{}
+}
+
+// signWebhook 受け取り側は同じ手順で計算した値と X-Isuumo-Signature を比べて検証する
+func signWebhook(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (d *WebhookDispatcher) count(result string) {
+	v, _ := d.results.LoadOrStore(result, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// Results メトリクス用に通知の結果ごとの件数を返す
+func (d *WebhookDispatcher) Results() map[string]int64 {
+	m := map[string]int64{}
+	d.results.Range(func(k, v interface{}) bool {
+		m[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return m
+}
+
+// Close 送り直しを待っている通知は捨て、キューに入っている通知を送り終えるまで待つ
+func (d *WebhookDispatcher) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for t := range d.timers {
+		if t.Stop() {
+			d.count(WebhookDropped)
+		}
+	}
+	d.timers = map[*time.Timer]struct{}{}
+	close(d.queue)
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// SavedSearches 保存した検索条件を追記型のファイルに持ち、投入された椅子や物件と照らし合わせて通知する
+// 照らし合わせはリクエストとは別のゴルーチンで行い、投入のレスポンスを待たせない
+type SavedSearches struct {
+	path         string
+	allowedHosts []string
+	maxSearches  int
+	maxPerClient int
+	createLimit  int
+	dispatcher   *WebhookDispatcher
+
+	mu       sync.RWMutex
+	searches map[string]*SavedSearch
+	clients  map[string]int // クライアント -> 保存している検索条件の数
+
+	fileMu  sync.Mutex
+	journal *os.File
+
+	// creations クライアントごとの直近1分間の作成回数
+	creations *gocache.Cache
+
+	queueMu sync.Mutex
+	closed  bool
+	matches chan []ListingEvent
+	done    chan struct{}
+}
+
+var savedSearches *SavedSearches
+
+// NewSavedSearches file が空なら検索条件を保存しない。ファイルがあれば保存済みの検索条件を読み込み、最新の状態だけに書き直す
+func NewSavedSearches(cfg SavedSearchConfig, dispatcher *WebhookDispatcher) (*SavedSearches, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	s := &SavedSearches{
+		path:         cfg.File,
+		allowedHosts: cfg.AllowedHosts,
+		maxSearches:  cfg.MaxSearches,
+		maxPerClient: cfg.MaxSearchesPerClient,
+		createLimit:  cfg.CreatePerMinute,
+		dispatcher:   dispatcher,
+		searches:     map[string]*SavedSearch{},
+		clients:      map[string]int{},
+		creations:    gocache.New(time.Minute, time.Minute),
+		matches:      make(chan []ListingEvent, cfg.QueueSize),
+		done:         make(chan struct{}),
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	var err error
+	s.journal, err = os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	go s.matcher()
+	return s, nil
+}
+
+// replay 検索条件ごとの最後の行を読み込む。削除した行が最後のものは読み込まない
+func (s *SavedSearches) replay() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		var search SavedSearch
+		if err := json.Unmarshal(line, &search); err != nil || search.ID == "" {
+			// 書き込み途中で落ちた最後の行は読み飛ばす
+			continue
+		}
+		if old, ok := s.searches[search.ID]; ok {
+			delete(s.searches, search.ID)
+			s.clients[old.Client]--
+		}
+		if search.Deleted {
+			continue
+		}
+		if err := search.compile(); err != nil {
+			return fmt.Errorf("%v: saved search %v: %v", s.path, search.ID, err)
+		}
+		s.searches[search.ID] = &search
+		s.clients[search.Client]++
+	}
+	return nil
+}
+
+// compact 保存している検索条件だけを作成順に書き直す
+func (s *SavedSearches) compact() error {
+	searches := make([]*SavedSearch, 0, len(s.searches))
+	for _, search := range s.searches {
+		searches = append(searches, search)
+	}
+	sort.Slice(searches, func(i, j int) bool { return searches[i].CreatedAt.Before(searches[j].CreatedAt) })
+	var buf bytes.Buffer
+	for _, search := range searches {
+		b, err := json.Marshal(search)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// record 1件分の行を追記する。検索条件の一覧のロックは持たずに呼ぶ
+func (s *SavedSearches) record(search SavedSearch) error {
+	b, err := json.Marshal(search)
+	if err != nil {
+		return err
+	}
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	_, err = s.journal.Write(append(b, '\n'))
+	return err
+}
+
+// Add IDと署名用の秘密鍵を振って保存する。client は作成したクライアントを区別するための値
+// 条件が読めない場合は errInvalidSavedSearch を、上限を超える場合は errSavedSearchQuota か errTooManySavedSearches を返す
+func (s *SavedSearches) Add(search SavedSearch, client string) (*SavedSearch, error) {
+	if err := search.compile(); err != nil {
+		return nil, errInvalidSavedSearch{err}
+	}
+	if err := validateCallbackURL(search.CallbackURL, s.allowedHosts); err != nil {
+		return nil, errInvalidSavedSearch{err}
+	}
+	if s.createLimit > 0 {
+		if err := s.creations.Add(client, 1, gocache.DefaultExpiration); err != nil {
+			if n, err := s.creations.IncrementInt(client, 1); err == nil && n > s.createLimit {
+				return nil, errSavedSearchQuota{"too many saved searches created in the last minute"}
+			}
+		}
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	search.ID, search.Secret, search.Client, search.CreatedAt, search.Deleted = id, secret, client, time.Now(), false
+
+	s.mu.Lock()
+	if len(s.searches) >= s.maxSearches {
+		s.mu.Unlock()
+		return nil, errTooManySavedSearches
+	}
+	if s.clients[client] >= s.maxPerClient {
+		s.mu.Unlock()
+		return nil, errSavedSearchQuota{"too many saved searches for this client"}
+	}
+	s.searches[id] = &search
+	s.clients[client]++
+	s.mu.Unlock()
+
+	if err := s.record(search); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	copied := search
+	copied.Client = ""
+	return &copied, nil
+}
+
+type errInvalidSavedSearch struct {
+	err error
+}
+
+func (e errInvalidSavedSearch) Error() string {
+	return fmt.Sprintf("invalid saved search: %v", e.err)
+}
+
+type errSavedSearchQuota struct {
+	reason string
+}
+
+func (e errSavedSearchQuota) Error() string {
+	return e.reason
+}
+
+var errTooManySavedSearches = fmt.Errorf("saved search limit reached")
+
+// Get 秘密鍵と作成したクライアントを除いたコピーを返す
+func (s *SavedSearches) Get(id string) (SavedSearch, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	search, ok := s.searches[id]
+	if !ok {
+		return SavedSearch{}, false
+	}
+	copied := *search
+	copied.Secret, copied.Client = "", ""
+	return copied, true
+}
+
+func (s *SavedSearches) remove(id string) (*SavedSearch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	search, ok := s.searches[id]
+	if !ok {
+		return nil, false
+	}
+	delete(s.searches, id)
+	s.clients[search.Client]--
+	if s.clients[search.Client] == 0 {
+		delete(s.clients, search.Client)
+	}
+	return search, true
+}
+
+func (s *SavedSearches) Delete(id string) (bool, error) {
+	search, ok := s.remove(id)
+	if !ok {
+		return false, nil
+	}
+	if err := s.record(SavedSearch{ID: id, Deleted: true}); err != nil {
+		s.mu.Lock()
+		s.searches[id] = search
+		s.clients[search.Client]++
+		s.mu.Unlock()
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SavedSearches) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.searches)
+}
+
+// notify 新しく投入された椅子や物件を照らし合わせ待ちに入れる。待ちが一杯なら通知せずに捨てる
+func (s *SavedSearches) notify(events []ListingEvent) {
+	if s == nil {
+		return
+	}
+	created := []ListingEvent{}
+	for _, ev := range events {
+		if ev.Type == EventChairCreated || ev.Type == EventEstateCreated {
+			created = append(created, ev)
+		}
+	}
+	if len(created) == 0 {
+		return
+	}
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.matches <- created:
+	default:
+		s.dispatcher.count(WebhookDropped)
+	}
+}
+
+func (s *SavedSearches) matcher() {
+	defer close(s.done)
+	for created := range s.matches {
+		s.match(created)
+	}
+}
+
+// match 保存した検索条件ごとに合ったものをまとめて通知する
+func (s *SavedSearches) match(created []ListingEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	for _, search := range s.searches {
+		listings := []json.RawMessage{}
+		for _, ev := range created {
+			if ev.Kind == search.Kind && search.match(ev) {
+				listings = append(listings, ev.Listing)
+			}
+		}
+		if len(listings) == 0 {
+			continue
+		}
+		id, err := newRandomID()
+		if err != nil {
+			continue
+		}
+		body, err := json.Marshal(WebhookNotification{DeliveryID: id, SearchID: search.ID, Kind: search.Kind, Listings: listings, Time: now})
+		if err != nil {
+			continue
+		}
+		s.dispatcher.Send(id, search.CallbackURL, []byte(search.Secret), body)
+	}
+}
+
+// Close 照らし合わせ待ちのものを通知に回し終えてからファイルを閉じる。通知を送るのは dispatcher の Close で待つ
+func (s *SavedSearches) Close() error {
+	s.queueMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.matches)
+	}
+	s.queueMu.Unlock()
+	<-s.done
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	return s.journal.Close()
+}
+
+// savedSearchClient 作成したクライアントを、IPアドレスをそのまま保存せずに区別する
+func savedSearchClient(c echo.Context) string {
+	sum := sha256.Sum256([]byte(c.RealIP()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// postSavedSearch POST /api/saved_search {"kind":"estate","query":"rentRangeId=1&features=...","nazotte":{...},"callbackUrl":"https://..."}
+// 通知の署名を検証するための秘密鍵は作成時のレスポンスでだけ返す
+func postSavedSearch(c echo.Context) error {
+	if savedSearches == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	var search SavedSearch
+	if err := c.Bind(&search); err != nil {
+		c.Echo().Logger.Infof("post saved search failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	saved, err := savedSearches.Add(search, savedSearchClient(c))
+	switch err.(type) {
+	case nil:
+	case errInvalidSavedSearch:
+		c.Echo().Logger.Infof("post saved search failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	case errSavedSearchQuota:
+		c.Echo().Logger.Infof("post saved search rejected : %v", err)
+		c.Response().Header().Set("Retry-After", "60")
+		return c.NoContent(http.StatusTooManyRequests)
+	default:
+		if err == errTooManySavedSearches {
+			c.Echo().Logger.Infof("post saved search rejected : %v", err)
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+		c.Logger().Errorf("failed to save search : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/api/saved_search/"+saved.ID)
+	return c.JSON(http.StatusCreated, saved)
+}
+
+func getSavedSearch(c echo.Context) error {
+	if savedSearches == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	search, ok := savedSearches.Get(c.Param("id"))
+	if !ok {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, search)
+}
+
+func deleteSavedSearch(c echo.Context) error {
+	if savedSearches == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	deleted, err := savedSearches.Delete(c.Param("id"))
+	if err != nil {
+		c.Logger().Errorf("failed to delete saved search : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !deleted {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// searchRangeParam 検索のクエリパラメータのうち範囲を表すもの
+type searchRangeParam struct {
+	name  string
+	cond  RangeCondition
+	value func(v interface{}) int64
+}
+
+// inRange 検索のSQLと同じく Min, Max が -1 なら制限しない。Max は含まない
+func inRange(r *Range, v int64) bool {
+	if r.Min != -1 && v < r.Min {
+		return false
+	}
+	if r.Max != -1 && v >= r.Max {
+		return false
+	}
+	return true
+}
+
+// containsFeatures features の各項目を LIKE '%f%' と同じく部分一致で確かめる
+func containsFeatures(features, wanted string) bool {
+	if wanted == "" {
+		return true
+	}
+	for _, f := range strings.Split(wanted, ",") {
+		if !strings.Contains(features, f) {
+			return false
+		}
+	}
+	return true
+}
+
+func rangeMatchers(q url.Values, params []searchRangeParam) ([]func(v interface{}) bool, error) {
+	matchers := []func(v interface{}) bool{}
+	for _, p := range params {
+		id := q.Get(p.name)
+		if id == "" {
+			continue
+		}
+		r, err := getRange(p.cond, id)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", p.name, err)
+		}
+		value := p.value
+		matchers = append(matchers, func(v interface{}) bool {
+			return inRange(r, value(v))
+		})
+	}
+	return matchers, nil
+}
+
+// chairMatcher /api/chair/search と同じクエリパラメータから、椅子が検索条件に合うかを判定する関数を作る
+// 在庫の有無は見ないため、呼び出し側で必要に応じて確かめる
+func chairMatcher(q url.Values) (func(Chair) bool, error) {
+	ranges, err := rangeMatchers(q, []searchRangeParam{
+		{"priceRangeId", chairSearchCondition.Price, func(v interface{}) int64 { return v.(Chair).Price }},
+		{"heightRangeId", chairSearchCondition.Height, func(v interface{}) int64 { return v.(Chair).Height }},
+		{"widthRangeId", chairSearchCondition.Width, func(v interface{}) int64 { return v.(Chair).Width }},
+		{"depthRangeId", chairSearchCondition.Depth, func(v interface{}) int64 { return v.(Chair).Depth }},
+	})
+	if err != nil {
+		return nil, err
+	}
+	kind, color, features := q.Get("kind"), q.Get("color"), q.Get("features")
+	return func(chair Chair) bool {
+		for _, m := range ranges {
+			if !m(chair) {
+				return false
+			}
+		}
+		if kind != "" && chair.Kind != kind {
+			return false
+		}
+		if color != "" && chair.Color != color {
+			return false
+		}
+		return containsFeatures(chair.Features, features)
+	}, nil
+}
+
+// estateMatcher /api/estate/search と同じクエリパラメータから、物件が検索条件に合うかを判定する関数を作る
+func estateMatcher(q url.Values) (func(Estate) bool, error) {
+	ranges, err := rangeMatchers(q, []searchRangeParam{
+		{"doorHeightRangeId", estateSearchCondition.DoorHeight, func(v interface{}) int64 { return v.(Estate).DoorHeight }},
+		{"doorWidthRangeId", estateSearchCondition.DoorWidth, func(v interface{}) int64 { return v.(Estate).DoorWidth }},
+		{"rentRangeId", estateSearchCondition.Rent, func(v interface{}) int64 { return v.(Estate).Rent }},
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefecture, city, features := q.Get("prefecture"), q.Get("city"), q.Get("features")
+	return func(estate Estate) bool {
+		for _, m := range ranges {
+			if !m(estate) {
+				return false
+			}
+		}
+		if prefecture != "" && estate.Prefecture != prefecture {
+			return false
+		}
+		if city != "" && estate.City != city {
+			return false
+		}
+		return containsFeatures(estate.Features, features)
+	}, nil
+}
+
+// chairFromRecord parseChairRecord で読み取った行を Chair にする
+func chairFromRecord(row map[string]interface{}) Chair {
+	return Chair{
+		ID:          int64(row["id"].(int)),
+		Name:        row["name"].(string),
+		Description: row["description"].(string),
+		Thumbnail:   row["thumbnail"].(string),
+		Price:       int64(row["price"].(int)),
+		Height:      int64(row["height"].(int)),
+		Width:       int64(row["width"].(int)),
+		Depth:       int64(row["depth"].(int)),
+		Color:       row["color"].(string),
+		Features:    row["features"].(string),
+		Kind:        row["kind"].(string),
+		Popularity:  int64(row["popularity"].(int)),
+		Stock:       int64(row["stock"].(int)),
+	}
+}
+
+// estateFromRecord parseEstateRecord で読み取った行を Estate にする
+func estateFromRecord(row map[string]interface{}) Estate {
+	return Estate{
+		ID:          int64(row["id"].(int)),
+		Name:        row["name"].(string),
+		Description: row["description"].(string),
+		Thumbnail:   row["thumbnail"].(string),
+		Address:     row["address"].(string),
+		Prefecture:  row["prefecture"].(string),
+		City:        row["city"].(string),
+		Latitude:    row["latitude"].(float64),
+		Longitude:   row["longitude"].(float64),
+		Rent:        int64(row["rent"].(int)),
+		DoorHeight:  int64(row["door_height"].(int)),
+		DoorWidth:   int64(row["door_width"].(int)),
+		Features:    row["features"].(string),
+		Popularity:  int64(row["popularity"].(int)),
+		Status:      EstateStatusAvailable,
+	}
+}
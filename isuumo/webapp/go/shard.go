@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ShardRouter 椅子を id % シャード数 で複数のMySQLに振り分ける
+// IDが決まる参照と更新は1つのシャードに、検索や一覧は全シャードに投げて結果を合わせる
+type ShardRouter struct {
+	shards []*Cluster
+	envs   []MySQLConnectionEnv
+}
+
+type ShardConfig struct {
+	Primary  MySQLConnectionEnv   `json:"primary"`
+	Replicas []MySQLConnectionEnv `json:"replicas"`
+}
+
+// NewShardRouter シャードが1つの場合はシャードなしの構成と同じ名前でメトリクスに出す
+func NewShardRouter(name string, shards []ShardConfig, conf MySQLConfig) (*ShardRouter, error) {
+	r := &ShardRouter{}
+	for i, s := range shards {
+		clusterName := name
+		if len(shards) > 1 {
+			clusterName = fmt.Sprintf("%s-shard-%d", name, i)
+		}
+		cluster, err := NewCluster(clusterName, s.Primary, s.Replicas, conf)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.shards = append(r.shards, cluster)
+		r.envs = append(r.envs, s.Primary)
+	}
+	return r, nil
+}
+
+func (r *ShardRouter) shardIndex(id int64) int {
+	i := int(id % int64(len(r.shards)))
+	if i < 0 {
+		i += len(r.shards)
+	}
+	return i
+}
+
+func (r *ShardRouter) shard(id int64) *Cluster {
+	return r.shards[r.shardIndex(id)]
+}
+
+// scatter 全シャードに並行してクエリを投げる。1つでも失敗したら残りを打ち切ってそのエラーを返す
+func (r *ShardRouter) scatter(ctx context.Context, f func(ctx context.Context, i int, shard *Cluster) error) error {
+	if len(r.shards) == 1 {
+		return f(ctx, 0, r.shards[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i, shard := range r.shards {
+		wg.Add(1)
+		go func(i int, shard *Cluster) {
+			defer wg.Done()
+			if err := f(ctx, i, shard); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// groupIDs IDをシャードごとに分ける
+func (r *ShardRouter) groupIDs(ids []int64) [][]int64 {
+	groups := make([][]int64, len(r.shards))
+	for _, id := range ids {
+		i := r.shardIndex(id)
+		groups[i] = append(groups[i], id)
+	}
+	return groups
+}
+
+func (r *ShardRouter) PreparexContext(ctx context.Context, query string) (*ShardedStmt, error) {
+	ss := &ShardedStmt{router: r}
+	for _, shard := range r.shards {
+		stmt, err := shard.PreparexContext(ctx, query)
+		if err != nil {
+			ss.Close()
+			return nil, err
+		}
+		ss.stmts = append(ss.stmts, stmt)
+	}
+	return ss, nil
+}
+
+func (r *ShardRouter) PingContext(ctx context.Context) error {
+	return r.scatter(ctx, func(ctx context.Context, _ int, shard *Cluster) error {
+		return shard.PingContext(ctx)
+	})
+}
+
+func (r *ShardRouter) nodes() map[string]*DB {
+	m := map[string]*DB{}
+	for _, shard := range r.shards {
+		for name, db := range shard.nodes() {
+			m[name] = db
+		}
+	}
+	return m
+}
+
+func (r *ShardRouter) ReplicaStats() []ReplicaStat {
+	stats := []ReplicaStat{}
+	for _, shard := range r.shards {
+		stats = append(stats, shard.ReplicaStats()...)
+	}
+	return stats
+}
+
+func (r *ShardRouter) Close() error {
+	for _, shard := range r.shards {
+		shard.Close()
+	}
+	return nil
+}
+
+// ShardedStmt 各シャードで準備したプリペアドステートメント
+type ShardedStmt struct {
+	router *ShardRouter
+	stmts  []*ClusterStmt
+}
+
+func (ss *ShardedStmt) on(id int64) *ClusterStmt {
+	return ss.stmts[ss.router.shardIndex(id)]
+}
+
+func (ss *ShardedStmt) Close() error {
+	for _, stmt := range ss.stmts {
+		stmt.Close()
+	}
+	return nil
+}
+
+// mergeChairs 各シャードで並べ替え済みの結果をまとめ、全体での [offset, offset+limit) を返す
+func mergeChairs(lists [][]Chair, less func(a, b Chair) bool, offset, limit int) []Chair {
+	merged := []Chair{}
+	for _, l := range lists {
+		merged = append(merged, l...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return less(merged[i], merged[j])
+	})
+	if offset >= len(merged) {
+		return []Chair{}
+	}
+	merged = merged[offset:]
+	if limit < len(merged) {
+		merged = merged[:limit]
+	}
+	return merged
+}
+
+// chairPopularityOrder "ORDER BY popularity_reversed, id ASC" と同じ順序
+func chairPopularityOrder(a, b Chair) bool {
+	if a.PopularityReversed != b.PopularityReversed {
+		return a.PopularityReversed < b.PopularityReversed
+	}
+	return a.ID < b.ID
+}
+
+// chairPriceOrder "ORDER BY price ASC, id ASC" と同じ順序
+func chairPriceOrder(a, b Chair) bool {
+	if a.Price != b.Price {
+		return a.Price < b.Price
+	}
+	return a.ID < b.ID
+}
+
+// lowPricedChairs 各シャードの安い順の上位を合わせて全体の上位を返す
+// 在庫台帳で売り切れてまだ書き出していない椅子は、その数だけ多めに取り出して除く
+func lowPricedChairs(ctx context.Context) ([]Chair, error) {
+	var soldOut []int64
+	if stockLedger != nil {
+		soldOut = stockLedger.SoldOut()
+	}
+	limit := config.Search.Limit + len(soldOut)
+	lists := make([][]Chair, len(dbChair.shards))
+	err := dbChair.scatter(ctx, func(ctx context.Context, i int, _ *Cluster) error {
+		return stmtGetLowPricedChair.stmts[i].SelectContext(ctx, &lists[i], limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(soldOut) > 0 {
+		excluded := make(map[int64]bool, len(soldOut))
+		for _, id := range soldOut {
+			excluded[id] = true
+		}
+		for i, list := range lists {
+			kept := list[:0]
+			for _, chair := range list {
+				if !excluded[chair.ID] {
+					kept = append(kept, chair)
+				}
+			}
+			lists[i] = kept
+		}
+	}
+	return mergeChairs(lists, chairPriceOrder, 0, config.Search.Limit), nil
+}
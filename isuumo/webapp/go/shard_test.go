@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testShardRouter(n int) *ShardRouter {
+	r := &ShardRouter{}
+	for i := 0; i < n; i++ {
+		r.shards = append(r.shards, &Cluster{name: "test"})
+	}
+	return r
+}
+
+func chairIDs(chairs []Chair) []int64 {
+	ids := []int64{}
+	for _, c := range chairs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// 各シャードから先頭の OFFSET + LIMIT 件を取り出して合わせると、1つのテーブルでの LIMIT OFFSET と同じページになる
+func Test_MergeChairsMatchesSingleTablePaging(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	router := testShardRouter(3)
+	all := []Chair{}
+	for id := int64(1); id <= 100; id++ {
+		// 人気が同じ椅子も混ぜて id での並びも確かめる
+		all = append(all, Chair{ID: id, PopularityReversed: int64(rnd.Intn(20)), Price: int64(rnd.Intn(30))})
+	}
+	for _, order := range []func(a, b Chair) bool{chairPopularityOrder, chairPriceOrder} {
+		sorted := append([]Chair{}, all...)
+		sort.Slice(sorted, func(i, j int) bool { return order(sorted[i], sorted[j]) })
+		shards := make([][]Chair, len(router.shards))
+		for _, c := range sorted {
+			i := router.shardIndex(c.ID)
+			shards[i] = append(shards[i], c)
+		}
+
+		const perPage = 7
+		for page := 0; page*perPage <= len(all); page++ {
+			offset := page * perPage
+			lists := make([][]Chair, len(shards))
+			for i, s := range shards {
+				n := offset + perPage
+				if n > len(s) {
+					n = len(s)
+				}
+				lists[i] = s[:n]
+			}
+			want := []Chair{}
+			if offset < len(sorted) {
+				end := offset + perPage
+				if end > len(sorted) {
+					end = len(sorted)
+				}
+				want = sorted[offset:end]
+			}
+			if got := mergeChairs(lists, order, offset, perPage); !reflect.DeepEqual(chairIDs(got), chairIDs(want)) {
+				t.Fatalf("page %d = %v, want %v", page, chairIDs(got), chairIDs(want))
+			}
+		}
+	}
+}
+
+func Test_ShardRouterGroupsIDs(t *testing.T) {
+	router := testShardRouter(3)
+	groups := router.groupIDs([]int64{1, 2, 3, 4, 5, 6, -1})
+	want := [][]int64{{3, 6}, {1, 4}, {2, 5, -1}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %v, want %v", groups, want)
+	}
+	if router.shard(7) != router.shards[1] {
+		t.Errorf("id 7 must go to shard 1")
+	}
+}
+
+func Test_ShardRouterScatterReturnsFirstError(t *testing.T) {
+	router := testShardRouter(3)
+	failure := errors.New("shard 1 is down")
+	cancelled := make(chan struct{}, len(router.shards))
+	err := router.scatter(context.Background(), func(ctx context.Context, i int, _ *Cluster) error {
+		if i == 1 {
+			return failure
+		}
+		// 他のシャードは失敗を受けて打ち切られる
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return ctx.Err()
+	})
+	if err != failure {
+		t.Errorf("scatter = %v, want %v", err, failure)
+	}
+	if len(cancelled) != 2 {
+		t.Errorf("%d shards were cancelled, want 2", len(cancelled))
+	}
+}
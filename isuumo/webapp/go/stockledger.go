@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stockFlushTimeout 1回の書き出しでシャードごとのトランザクションにかける締め切り
+const stockFlushTimeout = 5 * time.Second
+
+// stockJournalCompactBytes 書き出しが続いて未反映の購入が残り続けても、ジャーナルがこの大きさを超えたら書き出し済みの部分を捨てる
+const stockJournalCompactBytes = 1 << 20
+
+// stockCheckpointTable mysql/db/0_Schema.sql の chair_stock_checkpoint と同じ定義
+const stockCheckpointTable = `CREATE TABLE IF NOT EXISTS chair_stock_checkpoint (id TINYINT NOT NULL PRIMARY KEY, seq BIGINT NOT NULL)`
+
+// StockLedger 椅子の在庫をメモリ上で管理し、購入の可否をロックの中だけで決める
+// 購入はジャーナルに fsync してから返し、在庫の減少はまとめてMySQLに書き出す
+// 同時に来た購入は1回の fsync にまとめ、fsync の間は在庫のロックを持たない
+// 各シャードには書き出し済みの通し番号を chair_stock_checkpoint に同じトランザクションで記録し、
+// 起動時にはそれより新しいジャーナルの購入だけを未反映として読み直す
+// ロックは flushMu, syncMu, mu の順に取る
+type StockLedger struct {
+	mu      sync.Mutex
+	stock   map[int64]int64 // 書き出し前の減少分を差し引いた在庫
+	pending map[int64]int64 // ジャーナルに記録済みで、まだMySQLに書き出していない減少数
+	// soldOut 在庫がなくなったがMySQLにはまだ書き出していない椅子。検索から除く
+	soldOut map[int64]struct{}
+	seq     int64
+	// durable ジャーナルに fsync 済みの通し番号。pending の購入はすべてこれ以下
+	durable int64
+	cur     *journalBatch
+	// suspended /initialize でデータを入れ直している間は、購入も在庫の読み込みも書き出しもしない
+	suspended bool
+
+	// syncMu ジャーナルへの書き込みは1つずつ行う
+	syncMu      sync.Mutex
+	journal     *os.File
+	path        string
+	journalSize int64
+
+	// flushMu 書き出し中に在庫を読み込むと減少分を二重に差し引くため、読み込みと書き出しを排他にする
+	flushMu sync.RWMutex
+
+	batchSize int
+	kick      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+
+	flushes      int64
+	flushErrors  int64
+	flushedUnits int64
+}
+
+type stockJournalEntry struct {
+	Seq int64 `json:"seq"`
+	ID  int64 `json:"id"`
+}
+
+// journalBatch 同じ fsync でジャーナルに記録する購入。done を閉じた後の err がその結果
+type journalBatch struct {
+	buf  []byte
+	ids  []int64
+	upto int64
+	done chan struct{}
+	err  error
+}
+
+func newJournalBatch() *journalBatch {
+	return &journalBatch{done: make(chan struct{})}
+}
+
+var errStockLedgerReset = fmt.Errorf("stock ledger was reset")
+
+var errStockLedgerSuspended = fmt.Errorf("stock ledger is suspended while reloading data")
+
+var stockLedger *StockLedger
+
+// NewStockLedger path が空ならメモリ上の在庫管理は使わず、購入ごとにMySQLで在庫を確認する
+func NewStockLedger(path string, interval time.Duration, batchSize int) (*StockLedger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	l := &StockLedger{
+		stock:     map[int64]int64{},
+		pending:   map[int64]int64{},
+		soldOut:   map[int64]struct{}{},
+		cur:       newJournalBatch(),
+		path:      path,
+		batchSize: batchSize,
+		kick:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if err := l.recover(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.journal, l.journalSize, l.durable = f, info.Size(), l.seq
+	if err := l.flush(); err != nil {
+		return nil, err
+	}
+	go l.flushLoop(interval)
+	return l, nil
+}
+
+// recover ジャーナルのうち、各シャードの書き出し済みの通し番号より新しい購入を未反映として読み込む
+func (l *StockLedger) recover(path string) error {
+	checkpoints := make([]int64, len(dbChair.shards))
+	ctx, cancel := context.WithTimeout(context.Background(), stockFlushTimeout)
+	defer cancel()
+	for i, shard := range dbChair.shards {
+		// /initialize 前の古いスキーマのDBでも起動できるよう、チェックポイントのテーブルがなければ作る
+		if _, err := shard.primary.ExecContext(ctx, stockCheckpointTable); err != nil {
+			return err
+		}
+		var seqs []int64
+		if err := shard.primary.SelectContext(ctx, &seqs, "SELECT seq FROM chair_stock_checkpoint WHERE id = 1"); err != nil {
+			return err
+		}
+		if len(seqs) > 0 {
+			checkpoints[i] = seqs[0]
+		}
+	}
+	return l.replay(path, checkpoints)
+}
+
+// replay ジャーナルを読み、シャードごとの書き出し済みの通し番号より新しい購入を pending に加える
+func (l *StockLedger) replay(path string, checkpoints []int64) error {
+	for _, seq := range checkpoints {
+		if seq > l.seq {
+			l.seq = seq
+		}
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e stockJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// 書き込み途中で落ちた最後の行は購入を返していないので読み飛ばす
+			continue
+		}
+		if e.Seq > checkpoints[dbChair.shardIndex(e.ID)] {
+			l.pending[e.ID]++
+		}
+		if e.Seq > l.seq {
+			l.seq = e.Seq
+		}
+	}
+	return scanner.Err()
+}
+
+// load 在庫をまだ知らない椅子についてプライマリから読み込む
+func (l *StockLedger) load(ctx context.Context, id int64) error {
+	l.flushMu.RLock()
+	defer l.flushMu.RUnlock()
+	l.mu.Lock()
+	suspended := l.suspended
+	l.mu.Unlock()
+	if suspended {
+		return errStockLedgerSuspended
+	}
+
+	var stock int64
+	err := dbChair.shard(id).primary.GetContext(ctx, &stock, "SELECT stock FROM chair WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.stock[id]; !ok {
+		l.stock[id] = stock - l.pending[id]
+	}
+	return nil
+}
+
+// Buy 在庫があれば1つ減らしてジャーナルに記録し、残りの在庫を返す。在庫がなければ false を返す
+// ジャーナルに記録できなかった場合は在庫を戻してエラーを返す。椅子が存在しない場合は sql.ErrNoRows を返す
+// データを入れ直している間は errStockLedgerSuspended を返す
+func (l *StockLedger) Buy(ctx context.Context, id int64) (int64, bool, error) {
+	l.mu.Lock()
+	suspended := l.suspended
+	_, loaded := l.stock[id]
+	l.mu.Unlock()
+	if suspended {
+		return 0, false, errStockLedgerSuspended
+	}
+	if !loaded {
+		if err := l.load(ctx, id); err != nil {
+			return 0, false, err
+		}
+	}
+
+	l.mu.Lock()
+	if l.suspended {
+		l.mu.Unlock()
+		return 0, false, errStockLedgerSuspended
+	}
+	if l.stock[id] <= 0 {
+		l.mu.Unlock()
+		return 0, false, nil
+	}
+	l.seq++
+	b, _ := json.Marshal(stockJournalEntry{Seq: l.seq, ID: id})
+	batch := l.cur
+	batch.buf = append(append(batch.buf, b...), '\n')
+	batch.ids = append(batch.ids, id)
+	batch.upto = l.seq
+	l.stock[id]--
+	remaining := l.stock[id]
+	if remaining <= 0 {
+		l.soldOut[id] = struct{}{}
+	}
+	l.mu.Unlock()
+
+	if err := l.sync(batch); err != nil {
+		return 0, false, err
+	}
+
+	l.mu.Lock()
+	full := len(l.pending) >= l.batchSize
+	l.mu.Unlock()
+	if full {
+		select {
+		case l.kick <- struct{}{}:
+		default:
+		}
+	}
+	return remaining, true, nil
+}
+
+// sync batch が記録されるまで待つ。先に来た購入がまだ記録していなければ、後から来た購入もまとめて記録する
+func (l *StockLedger) sync(batch *journalBatch) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	select {
+	case <-batch.done:
+		return batch.err
+	default:
+	}
+
+	l.mu.Lock()
+	// syncMu を持っている間に閉じていない batch は、まだ誰も取り出していない l.cur のはず
+	l.cur = newJournalBatch()
+	l.mu.Unlock()
+
+	_, err := l.journal.Write(batch.buf)
+	if err == nil {
+		err = l.journal.Sync()
+	}
+	l.mu.Lock()
+	if err != nil {
+		// 途中まで書けた行を残すと、再起動時に返していない購入を読み直してしまう
+		l.journal.Truncate(l.journalSize)
+		for _, id := range batch.ids {
+			l.stock[id]++
+			if l.stock[id] > 0 {
+				delete(l.soldOut, id)
+			}
+		}
+	} else {
+		l.journalSize += int64(len(batch.buf))
+		for _, id := range batch.ids {
+			l.pending[id]++
+		}
+		l.durable = batch.upto
+	}
+	l.mu.Unlock()
+	batch.err = err
+	close(batch.done)
+	return err
+}
+
+// SoldOut 在庫がなくなったがMySQLにはまだ反映していない椅子のID
+func (l *StockLedger) SoldOut() []int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ids := make([]int64, 0, len(l.soldOut))
+	for id := range l.soldOut {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Available 在庫を把握している椅子について、書き出し前の購入を反映した在庫を返す
+func (l *StockLedger) Available(id int64) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stock, ok := l.stock[id]
+	return stock, ok
+}
+
+// Suspend /initialize でデータを入れ直す前に呼び、Reset か Resume まで購入と書き出しを止める
+// 入れ直している途中のテーブルから在庫を読み込んだり、未反映の減少を書き出したりしないようにする
+func (l *StockLedger) Suspend() {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.suspended = true
+}
+
+// Resume Reset せずに購入を再開する。把握している在庫はMySQLから読み直す
+// データの入れ直しに失敗したときに、途中まで入れ直したテーブルとずれた在庫を使い続けないようにする
+func (l *StockLedger) Resume() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.suspended {
+		return
+	}
+	l.stock = map[int64]int64{}
+	l.suspended = false
+}
+
+// Reset /initialize でデータを入れ直した後に呼び、把握している在庫とジャーナルを捨てて購入を再開する
+func (l *StockLedger) Reset() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 記録を待っている購入は失敗させる
+	l.cur.err = errStockLedgerReset
+	close(l.cur.done)
+	l.cur = newJournalBatch()
+	l.stock = map[int64]int64{}
+	l.pending = map[int64]int64{}
+	l.soldOut = map[int64]struct{}{}
+	l.seq, l.durable, l.journalSize = 0, 0, 0
+	l.suspended = false
+	return l.journal.Truncate(0)
+}
+
+func (l *StockLedger) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.kick:
+		case <-l.done:
+			l.flush()
+			close(l.stopped)
+			return
+		}
+		l.flush()
+	}
+}
+
+// flush 未反映の減少をシャードごとに1つのトランザクションで書き出す
+// 失敗したシャードの分は未反映に戻し、次の書き出しで再試行する
+func (l *StockLedger) flush() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	l.mu.Lock()
+	if l.suspended || len(l.pending) == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	batch := l.pending
+	seq := l.durable
+	l.pending = map[int64]int64{}
+	l.mu.Unlock()
+
+	groups := make([]map[int64]int64, len(dbChair.shards))
+	for id, n := range batch {
+		i := dbChair.shardIndex(id)
+		if groups[i] == nil {
+			groups[i] = map[int64]int64{}
+		}
+		groups[i][id] = n
+	}
+
+	var firstErr error
+	var units int64
+	for i, group := range groups {
+		if group == nil {
+			continue
+		}
+		if err := flushShard(dbChair.shards[i], group, seq); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("flush stock to %v: %v", dbChair.shards[i].name, err)
+			}
+			l.mu.Lock()
+			for id, n := range group {
+				l.pending[id] += n
+			}
+			l.mu.Unlock()
+			continue
+		}
+		l.mu.Lock()
+		for id, n := range group {
+			units += n
+			// MySQLの在庫も0になったので、検索の条件だけで除ける
+			if _, ok := l.pending[id]; !ok && l.stock[id] <= 0 {
+				delete(l.soldOut, id)
+			}
+		}
+		l.mu.Unlock()
+	}
+
+	atomic.AddInt64(&l.flushes, 1)
+	atomic.AddInt64(&l.flushedUnits, units)
+	if units > 0 {
+		chairDataVersion.bump()
+	}
+	if firstErr != nil {
+		atomic.AddInt64(&l.flushErrors, 1)
+		return firstErr
+	}
+
+	return l.compact(seq)
+}
+
+// compact すべてのシャードに seq まで書き出せたので、ジャーナルのそれ以前の購入を捨てる
+// 書き出し中に記録された購入が残っていれば、ジャーナルが大きくなったときだけ残りを書き直す
+func (l *StockLedger) compact(seq int64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	durable := l.durable
+	l.mu.Unlock()
+	if durable <= seq {
+		l.journalSize = 0
+		return l.journal.Truncate(0)
+	}
+	if l.journalSize < stockJournalCompactBytes {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		var e stockJournalEntry
+		if err := json.Unmarshal(line, &e); err != nil || e.Seq <= seq {
+			continue
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.journal.Close()
+	l.journal, l.journalSize = journal, int64(buf.Len())
+	return nil
+}
+
+func flushShard(shard *Cluster, group map[int64]int64, seq int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stockFlushTimeout)
+	defer cancel()
+	tx, err := shard.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, n := range group {
+		if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock - ? WHERE id = ?", n, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO chair_stock_checkpoint (id, seq) VALUES (1, ?) ON DUPLICATE KEY UPDATE seq = VALUES(seq)", seq); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close 残っている減少を書き出してジャーナルを閉じる
+func (l *StockLedger) Close() {
+	close(l.done)
+	<-l.stopped
+	l.journal.Close()
+}
+
+// currentStock 在庫を把握している椅子は書き出し前の購入を反映した在庫を返す
+func currentStock(chair Chair) int64 {
+	if stockLedger != nil {
+		if stock, ok := stockLedger.Available(chair.ID); ok {
+			return stock
+		}
+	}
+	return chair.Stock
+}
+
+func (l *StockLedger) pendingUnits() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var n int64
+	for _, v := range l.pending {
+		n += v
+	}
+	return n
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestStockLedger DBを使わずに在庫を与えたジャーナル付きの台帳を作る。書き出しのループは動かさない
+func newTestStockLedger(t *testing.T, path string, stock map[int64]int64) *StockLedger {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &StockLedger{
+		stock:     stock,
+		pending:   map[int64]int64{},
+		soldOut:   map[int64]struct{}{},
+		cur:       newJournalBatch(),
+		path:      path,
+		journal:   f,
+		batchSize: 1 << 20,
+		kick:      make(chan struct{}, 1),
+	}
+	// 書き直しでジャーナルを開き直すことがあるので、最後に持っているものを閉じる
+	t.Cleanup(func() { l.journal.Close() })
+	return l
+}
+
+func useTestChairShards(t *testing.T, n int) {
+	saved := dbChair
+	dbChair = testShardRouter(n)
+	t.Cleanup(func() { dbChair = saved })
+}
+
+func writeStockJournal(t *testing.T, path string, entries []stockJournalEntry, tail string) {
+	t.Helper()
+	var b strings.Builder
+	for _, e := range entries {
+		line, _ := json.Marshal(e)
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	b.WriteString(tail)
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_StockLedgerReplaysJournalAfterCheckpoints(t *testing.T) {
+	useTestChairShards(t, 2)
+	path := filepath.Join(tempDir(t), "stock_journal.jsonl")
+	writeStockJournal(t, path, []stockJournalEntry{
+		{Seq: 1, ID: 2}, {Seq: 2, ID: 1}, {Seq: 3, ID: 2}, {Seq: 4, ID: 1},
+		{Seq: 5, ID: 4}, {Seq: 6, ID: 3}, {Seq: 7, ID: 2},
+	}, `{"seq":8,"i`)
+
+	l := &StockLedger{pending: map[int64]int64{}}
+	// シャード0 (偶数のID) は3まで、シャード1 (奇数のID) は5まで書き出し済み
+	if err := l.replay(path, []int64{3, 5}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]int64{2: 1, 3: 1, 4: 1}
+	if !reflect.DeepEqual(l.pending, want) {
+		t.Errorf("pending = %v, want %v", l.pending, want)
+	}
+	// 書き込み途中の行は購入として数えず、通し番号も進めない
+	if l.seq != 7 {
+		t.Errorf("seq = %d, want 7", l.seq)
+	}
+
+	// ジャーナルがなくても書き出し済みの通し番号から続ける
+	l = &StockLedger{pending: map[int64]int64{}}
+	if err := l.replay(filepath.Join(tempDir(t), "missing.jsonl"), []int64{9, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if l.seq != 9 || len(l.pending) != 0 {
+		t.Errorf("seq = %d, pending = %v", l.seq, l.pending)
+	}
+}
+
+func Test_StockLedgerGroupCommitsPurchases(t *testing.T) {
+	useTestChairShards(t, 2)
+	path := filepath.Join(tempDir(t), "stock_journal.jsonl")
+	l := newTestStockLedger(t, path, map[int64]int64{1: 50, 2: 3})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	bought := map[int64]int{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			_, ok, err := l.Buy(context.Background(), id)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mu.Lock()
+				bought[id]++
+				mu.Unlock()
+			}
+		}(int64(1 + i%2))
+	}
+	wg.Wait()
+	if bought[1] != 50 || bought[2] != 3 {
+		t.Fatalf("bought = %v, want all 53 units and no more", bought)
+	}
+	if l.durable != 53 || !reflect.DeepEqual(l.pending, map[int64]int64{1: 50, 2: 3}) {
+		t.Fatalf("durable = %d, pending = %v", l.durable, l.pending)
+	}
+	if soldOut := l.SoldOut(); len(soldOut) != 2 {
+		t.Errorf("sold out = %v, want both chairs", soldOut)
+	}
+
+	// 返した購入はすべてジャーナルから読み直せる
+	replayed := &StockLedger{pending: map[int64]int64{}}
+	if err := replayed.replay(path, []int64{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed.pending, l.pending) || replayed.seq != 53 {
+		t.Errorf("replayed pending = %v, seq = %d", replayed.pending, replayed.seq)
+	}
+
+	if err := l.compact(53); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 || l.journalSize != 0 {
+		t.Errorf("journal must be truncated once everything is checkpointed, size %d", info.Size())
+	}
+}
+
+func Test_StockLedgerCompactsJournalToCheckpoint(t *testing.T) {
+	useTestChairShards(t, 1)
+	path := filepath.Join(tempDir(t), "stock_journal.jsonl")
+	l := newTestStockLedger(t, path, map[int64]int64{1: 10})
+	for i := 0; i < 5; i++ {
+		if _, _, err := l.Buy(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 書き出し中に購入が続いてジャーナルが大きくなった場合は、書き出し済みの部分だけを捨てる
+	l.journalSize = stockJournalCompactBytes
+	if err := l.compact(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.Buy(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	replayed := &StockLedger{pending: map[int64]int64{}}
+	if err := replayed.replay(path, []int64{0}); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.pending[1] != 3 || replayed.seq != 6 {
+		t.Errorf("after compaction the journal holds %d purchases up to seq %d, want 3 up to 6", replayed.pending[1], replayed.seq)
+	}
+}
+
+func Test_StockLedgerRestoresStockWhenJournalFails(t *testing.T) {
+	path := filepath.Join(tempDir(t), "stock_journal.jsonl")
+	l := newTestStockLedger(t, path, map[int64]int64{1: 1})
+	l.journal.Close()
+
+	if _, _, err := l.Buy(context.Background(), 1); err == nil {
+		t.Fatal("Buy must fail when the journal cannot be written")
+	}
+	if n, _ := l.Available(1); n != 1 {
+		t.Errorf("stock = %d, want the failed purchase returned", n)
+	}
+	if len(l.pending) != 0 || len(l.SoldOut()) != 0 {
+		t.Errorf("pending = %v, sold out = %v", l.pending, l.SoldOut())
+	}
+}
+
+func Test_StockLedgerRefusesPurchasesWhileReloading(t *testing.T) {
+	useTestChairShards(t, 1)
+	path := filepath.Join(tempDir(t), "stock_journal.jsonl")
+	l := newTestStockLedger(t, path, map[int64]int64{1: 5})
+	if _, _, err := l.Buy(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Suspend()
+	if _, _, err := l.Buy(context.Background(), 1); err != errStockLedgerSuspended {
+		t.Errorf("Buy = %v, want %v", err, errStockLedgerSuspended)
+	}
+	// 入れ直している途中のテーブルには書き出さない
+	if err := l.flush(); err != nil || l.pending[1] != 1 {
+		t.Errorf("flush = %v, pending = %v", err, l.pending)
+	}
+
+	// 入れ直しに失敗した場合は、把握していた在庫を捨ててMySQLから読み直す
+	l.Resume()
+	if _, ok := l.Available(1); ok {
+		t.Errorf("stock must be reloaded after an unfinished reload")
+	}
+
+	l.stock[1] = 5
+	l.Suspend()
+	if err := l.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	l.Resume()
+	l.stock[1] = 5
+	if _, ok, err := l.Buy(context.Background(), 1); err != nil || !ok {
+		t.Errorf("Buy after reset = %v, %v", ok, err)
+	}
+	if l.seq != 1 || !reflect.DeepEqual(l.pending, map[int64]int64{1: 1}) {
+		t.Errorf("seq = %d, pending = %v", l.seq, l.pending)
+	}
+}
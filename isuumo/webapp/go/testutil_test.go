@@ -0,0 +1,17 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// tempDir テストの終わりに消える一時ディレクトリを作る。go 1.14 には t.TempDir がない
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "isuumo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
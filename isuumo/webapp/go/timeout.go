@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// RouteTimeouts ルートごとのリクエストの締め切り
+// ルートのパス、負荷制御のグループ名、既定値の順に探し、0 なら締め切りを設けない
+type RouteTimeouts struct {
+	Default   time.Duration
+	Overrides map[string]time.Duration
+}
+
+var routeTimeouts *RouteTimeouts
+
+// defaultRouteTimeoutOverrides 初期化はデータの投入に時間がかかり、イベントの配信は接続を保ち続けるため締め切りを設けない
+var defaultRouteTimeoutOverrides = map[string]time.Duration{
+	"/initialize": 0,
+	"/api/events": 0,
+}
+
+func NewRouteTimeouts(def time.Duration, routes map[string]Duration) *RouteTimeouts {
+	t := &RouteTimeouts{Default: def, Overrides: map[string]time.Duration{}}
+	for k, v := range defaultRouteTimeoutOverrides {
+		t.Overrides[k] = v
+	}
+	for k, v := range routes {
+		t.Overrides[k] = time.Duration(v)
+	}
+	return t
+}
+
+// parseRouteTimeoutOverrides "/api/estate/nazotte=3s,chair=1s" 形式の設定をパースする
+func parseRouteTimeoutOverrides(s string) (map[string]time.Duration, error) {
+	overrides := map[string]time.Duration{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid route timeout: %q", entry)
+		}
+		d, err := time.ParseDuration(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid route timeout: %q: %v", entry, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid route timeout: %q: negative duration", entry)
+		}
+		overrides[strings.TrimSpace(entry[:i])] = d
+	}
+	return overrides, nil
+}
+
+func (t *RouteTimeouts) lookup(path string) time.Duration {
+	if d, ok := t.Overrides[path]; ok {
+		return d
+	}
+	if d, ok := t.Overrides[loadSheddingGroup(path)]; ok {
+		return d
+	}
+	return t.Default
+}
+
+// cancelReason ctx が打ち切られていればその理由を返す
+func cancelReason(ctx context.Context) string {
+	switch ctx.Err() {
+	case context.Canceled:
+		return "canceled"
+	case context.DeadlineExceeded:
+		return "deadline_exceeded"
+	}
+	return ""
+}
+
+// Middleware リクエストの context に締め切りを設定する
+// クライアントの切断や締め切りで打ち切られたリクエストはメトリクスに数える
+func (t *RouteTimeouts) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := req.Context()
+		if d := t.lookup(c.Path()); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+			c.SetRequest(req.WithContext(ctx))
+		}
+
+		err := next(c)
+		if reason := cancelReason(ctx); reason != "" {
+			c.Echo().Logger.Infof("request %v %v was cut off : %v", req.Method, c.Path(), reason)
+			metrics.addRequestCancellation(c.Path(), reason)
+		}
+		return err
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// OTLP の SpanKind
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// OTLP の StatusCode
+const (
+	SpanStatusUnset = 0
+	SpanStatusOK    = 1
+	SpanStatusError = 2
+)
+
+// traceExportBatchSize 1行に書き出すスパンの最大数
+const traceExportBatchSize = 512
+const traceExportInterval = time.Second
+const traceQueueSize = 8192
+
+const traceServiceName = "isuumo"
+
+type Span struct {
+	TraceID       string
+	SpanID        string
+	ParentSpanID  string
+	Name          string
+	Kind          int
+	Start         time.Time
+	End           time.Time
+	Attributes    map[string]interface{}
+	StatusCode    int
+	StatusMessage string
+
+	tracer *Tracer
+	// sampled false のスパンは trace-id を伝えるだけで記録しない
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+// Tracer 終了したスパンを OTLP/JSON 形式で1行ずつファイルに書き出す
+type Tracer struct {
+	queue   chan *Span
+	dropped int64
+	file    *os.File
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+var tracer *Tracer
+
+// NewTracer path が空ならトレースを記録しない
+func NewTracer(path string) (*Tracer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{
+		queue:   make(chan *Span, traceQueueSize),
+		file:    f,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go t.exportLoop()
+	return t, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent W3C Trace Context の traceparent ヘッダから trace-id, parent-id, sampled を取り出す
+func parseTraceparent(h string) (string, string, bool, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2] + parts[3]); err != nil {
+		return "", "", false, false
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+func formatTraceparent(s *Span) string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// startSpan 親スパンがあればその子として、なければ新しいトレースとしてスパンを始める
+// 親が記録しないスパンなら子も記録しない。トレースが無効な場合はnilを返す。nilのスパンに対する操作は何もしない
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		SpanID:     randomHex(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+		tracer:     tracer,
+		sampled:    true,
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+		s.sampled = parent.sampled
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// SetError sql.ErrNoRows のような正常系のエラーは呼び出し側で除外する
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.StatusCode = SpanStatusError
+	s.StatusMessage = err.Error()
+}
+
+func (s *Span) Finish() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.End = time.Now()
+	select {
+	case s.tracer.queue <- s:
+	default:
+		atomic.AddInt64(&s.tracer.dropped, 1)
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	w := bufio.NewWriter(t.file)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, traceExportBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			if b, err := json.Marshal(otlpExportRequest(batch)); err == nil {
+				w.Write(b)
+				w.WriteByte('\n')
+			}
+			batch = batch[:0]
+		}
+		w.Flush()
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceExportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+					if len(batch) >= traceExportBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					t.file.Close()
+					close(t.stopped)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close キューに残っているスパンを書き出してファイルを閉じる。以降に終了したスパンは捨てられる
+func (t *Tracer) Close() {
+	close(t.done)
+	<-t.stopped
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpValue(v interface{}) otlpAnyValue {
+	switch x := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &x}
+	case int:
+		s := strconv.Itoa(x)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &x}
+	case bool:
+		return otlpAnyValue{BoolValue: &x}
+	default:
+		s := fmt.Sprint(x)
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func otlpAttributes(m map[string]interface{}) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: otlpValue(v)})
+	}
+	return kvs
+}
+
+// otlpExportRequest OTLP/JSON の ExportTraceServiceRequest と同じ形にする
+func otlpExportRequest(spans []*Span) otlpTraceRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = traceServiceName
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            otlpStatus{Code: s.StatusCode, Message: s.StatusMessage},
+		})
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = otlpAttributes(map[string]interface{}{"service.name": traceServiceName})
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+// TracingMiddleware 受け取った traceparent を親としてハンドラ全体のスパンを記録する
+// 親が sampled でなければ、同じ trace-id を引き継いだ記録しないスパンをコンテキストに入れる
+func TracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if tracer == nil {
+			return next(c)
+		}
+		req := c.Request()
+		ctx := req.Context()
+		if traceID, parentID, sampled, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, &Span{TraceID: traceID, SpanID: parentID, sampled: sampled})
+		}
+		ctx, span := startSpan(ctx, req.Method+" "+c.Path(), SpanKindServer)
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.route", c.Path())
+		span.SetAttribute("http.target", req.RequestURI)
+		span.SetAttribute("http.request_id", requestID(c))
+		c.SetRequest(req.WithContext(ctx))
+		c.Response().Header().Set("traceparent", formatTraceparent(span))
+
+		err := next(c)
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		}
+		span.SetAttribute("http.status_code", status)
+		if err != nil || status >= 500 {
+			span.StatusCode = SpanStatusError
+			if err != nil {
+				span.StatusMessage = err.Error()
+			}
+		}
+		span.Finish()
+		return err
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// blockedCallbackNetworks 通知先として許可しないアドレス。ループバックとリンクローカルは net.IP のメソッドで判定する
+var blockedCallbackNetworks = func() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"fc00::/7",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}()
+
+// publicCallbackIP メタデータサーバ(169.254.169.254)や社内のホストに通知を送らせないよう、公開されたユニキャストアドレスだけを許可する
+func publicCallbackIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range blockedCallbackNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// callbackHostAllowed allowedHosts が空なら任意のホストを、そうでなければ列挙したホストだけを通知先にできる
+func callbackHostAllowed(host string, allowedHosts []string) bool {
+	if len(allowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range allowedHosts {
+		if strings.ToLower(allowed) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCallbackURL 登録時の検査。名前解決の結果は送信時に webhookDialer で確かめる
+func validateCallbackURL(callbackURL string, allowedHosts []string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid callbackUrl: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("callbackUrl must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return fmt.Errorf("callbackUrl must not contain credentials")
+	}
+	host := u.Hostname()
+	if !callbackHostAllowed(host, allowedHosts) {
+		return fmt.Errorf("callbackUrl host %q is not allowed", host)
+	}
+	if len(allowedHosts) > 0 {
+		return nil
+	}
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return fmt.Errorf("callbackUrl host %q is not allowed", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicCallbackIP(ip) {
+		return fmt.Errorf("callbackUrl address %v is not allowed", ip)
+	}
+	return nil
+}
+
+// webhookDialer 名前解決した結果のアドレスを検査し、そのアドレスに直接つなぐ
+// 検査と接続で別々に名前解決しないため、DNS の応答を途中で差し替えられても内部のアドレスにはつながらない
+type webhookDialer struct {
+	dialer       *net.Dialer
+	resolver     *net.Resolver
+	allowedHosts []string
+}
+
+func (d *webhookDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !callbackHostAllowed(host, d.allowedHosts) {
+		return nil, fmt.Errorf("callback host %q is not allowed", host)
+	}
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address for callback host %q", host)
+	}
+	// 許可したホストは社内の受け取り先のこともあるため、アドレスの検査はしない
+	if len(d.allowedHosts) == 0 {
+		for _, a := range addrs {
+			if !publicCallbackIP(a.IP) {
+				return nil, fmt.Errorf("callback host %q resolves to disallowed address %v", host, a.IP)
+			}
+		}
+	}
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// newWebhookClient 通知用の HTTP クライアント。環境変数のプロキシは使わず、リダイレクトにも従わない
+func newWebhookClient(timeout time.Duration, allowedHosts []string) *http.Client {
+	dialer := &webhookDialer{
+		dialer:       &net.Dialer{Timeout: timeout},
+		resolver:     net.DefaultResolver,
+		allowedHosts: allowedHosts,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
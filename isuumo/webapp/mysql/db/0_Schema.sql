@@ -3,6 +3,7 @@ CREATE DATABASE isuumo;
 
 DROP TABLE IF EXISTS isuumo.estate;
 DROP TABLE IF EXISTS isuumo.chair;
+DROP TABLE IF EXISTS isuumo.chair_stock_checkpoint;
 
 CREATE TABLE isuumo.estate
 (
@@ -11,6 +12,8 @@ CREATE TABLE isuumo.estate
     description VARCHAR(4096)       NOT NULL,
     thumbnail   VARCHAR(128)        NOT NULL,
     address     VARCHAR(128)        NOT NULL,
+    prefecture  VARCHAR(16)         NOT NULL DEFAULT '',
+    city        VARCHAR(64)         NOT NULL DEFAULT '',
     latitude    DOUBLE PRECISION    NOT NULL,
     longitude   DOUBLE PRECISION    NOT NULL,
     point       POINT AS (POINT(latitude, longitude)) STORED NOT NULL,
@@ -19,11 +22,15 @@ CREATE TABLE isuumo.estate
     door_width  INTEGER             NOT NULL,
     features    VARCHAR(64)         NOT NULL,
     popularity  INTEGER             NOT NULL,
-    popularity_reversed INTEGER AS (-popularity) STORED NOT NULL
+    popularity_reversed INTEGER AS (-popularity) STORED NOT NULL,
+    status      VARCHAR(16)         NOT NULL DEFAULT 'available',
+    status_changed_at DATETIME(6)   NULL
 );
 CREATE INDEX index_rent ON isuumo.estate(rent);
 CREATE INDEX index_popurarity_reversed ON isuumo.estate(popularity_reversed);
 CREATE SPATIAL INDEX index_sp_point ON isuumo.estate(point);
+CREATE INDEX index_status ON isuumo.estate(status);
+CREATE INDEX index_prefecture_city ON isuumo.estate(prefecture, city);
 
 CREATE TABLE isuumo.chair
 (
@@ -43,4 +50,10 @@ CREATE TABLE isuumo.chair
     stock       INTEGER         NOT NULL
 );
 CREATE INDEX index_price ON isuumo.chair(price);
-CREATE INDEX index_popurarity_reversed ON isuumo.chair(popularity_reversed);
\ No newline at end of file
+CREATE INDEX index_popurarity_reversed ON isuumo.chair(popularity_reversed);
+
+CREATE TABLE isuumo.chair_stock_checkpoint
+(
+    id          TINYINT         NOT NULL PRIMARY KEY,
+    seq         BIGINT          NOT NULL
+);
\ No newline at end of file